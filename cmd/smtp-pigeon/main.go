@@ -1,18 +1,28 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
 	"github.com/rktjmp/smtp-pigeon/internal/backend"
 	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/rktjmp/smtp-pigeon/internal/queue"
 	"github.com/rktjmp/smtp-pigeon/internal/session"
+	"github.com/rktjmp/smtp-pigeon/internal/spool"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/mail"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"text/template"
 	"time"
 )
@@ -27,51 +37,192 @@ var (
 )
 
 type flags struct {
-	help            bool        // show help
-	version         bool        // show version
-	prefixLogger    bool        // prefix logger with date-time
-	mailDomain      string      // SMTP "hostname"
-	listenHost      string      // listen server settings
+	help            bool   // show help
+	version         bool   // show version
+	prefixLogger    bool   // prefix logger with date-time
+	configFile      string // YAML or TOML file of options, endpoints and routes
+	mailDomain      string // SMTP "hostname"
+	listenHost      string // listen server settings
 	listenPort      int
-	endpointURL     string      // make post where
-	endpointHeaders stringSlice // {header, header}
-	templateString  string      // post what
+	endpoint        endpointFlags // deliver where and what
+	async           bool
+	workers         int
+	queueDepth      int
+	spoolDir        string
+	spoolInterval   time.Duration
+	metricsListen   string
+	shutdownTimeout time.Duration
+	watchConfig     bool
+	templateEnv     stringSlice // environment variables templates may read
+	secretsDir      string
+	templateDir     string
+	dedupTTL        time.Duration
+	dedupKey        string
+	redact          stringSlice // {builtin, name=pattern, ...}
+	redactHeaders   stringSlice
 }
 
-func parseFlags() *flags {
-	var defaultTemplate = config.DefaultTemplateString()
-	flags := flags{}
+// endpointFlags are the options each endpoint in a config file may also set
+type endpointFlags struct {
+	url            string      // deliver where
+	headers        stringSlice // {header, header}
+	template       string      // post what
+	templateFile   string
+	templateName   string
+	syslogSeverity stringSlice // {severity=pattern, ...}
+	http           config.HTTPOptions
+	signing        config.SigningOptions
+	oauth          config.OAuthOptions
+	breaker        config.BreakerOptions
+	rateLimit      config.RateLimitOptions
+}
+
+func defaultEndpointFlags() endpointFlags {
+	return endpointFlags{
+		template:  config.DefaultTemplateString(),
+		http:      *config.DefaultHTTPOptions(),
+		signing:   config.SigningOptions{Style: "stripe", Algorithm: "sha256"},
+		oauth:     config.OAuthOptions{RefreshBefore: time.Minute},
+		breaker:   config.BreakerOptions{OpenFor: 30 * time.Second},
+		rateLimit: config.RateLimitOptions{Burst: 1, MaxQueue: 100, Overflow: "tempfail"},
+	}
+}
+
+// parseFlags parses the command line into a new flag set, so it can be done
+// again when reloading.
+func parseFlags(args []string) (*flags, *flag.FlagSet, error) {
+	flags, fs := newFlags(os.Args[0])
+	err := fs.Parse(args)
+
+	return flags, fs, err
+}
+
+// commandLineOnly flags can't be set by the environment or a config file
+var commandLineOnly = map[string]bool{
+	"help":    true,
+	"version": true,
+	"message": true,
+	"from":    true,
+	"to":      true,
+}
+
+// newFlags creates a flag set for the server's options, which subcommands
+// may add to before parsing.
+func newFlags(name string) (*flags, *flag.FlagSet) {
+	flags := flags{endpoint: defaultEndpointFlags()}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	fs.BoolVar(&flags.version, "version", false, "Show version information")
+	fs.BoolVar(&flags.help, "help", false, "View this text")
+	fs.BoolVar(&flags.prefixLogger, "standalone-logging", false, "Prefix logs with date and time")
+	fs.StringVar(&flags.configFile, "config", "", `YAML (.yaml, .yml) or TOML (.toml) file of options, named like these flags without "--".
+May also define "endpoints" and "routes". Every option may also be set by an SMTP_PIGEON_ variable, eg SMTP_PIGEON_RATE_LIMIT.
+The command line overrides the environment, which overrides the file`)
+	fs.BoolVar(&flags.watchConfig, "watch-config", false, "Reload when --config or template files change, as well as on SIGHUP")
+	fs.StringVar(&flags.mailDomain, "domain", "localhost", "Mail domain to reply to EHLO with")
+	fs.StringVar(&flags.listenHost, "host", "127.0.0.1", "Address to bind to")
+	fs.BoolVar(&flags.async, "async", false, `Accept mail as soon as it is received and deliver it in the background.
+Mail is refused with "421 4.3.2" when the queue is full, failed deliveries are spooled if --spool-dir is set`)
+	fs.IntVar(&flags.workers, "workers", 4, "Number of background deliveries made at once with --async")
+	fs.IntVar(&flags.queueDepth, "queue-depth", 100, "Maximum mail waiting for a worker with --async")
+	fs.StringVar(&flags.spoolDir, "spool-dir", "", "Directory to store mail that can't be delivered yet, retried every --spool-interval")
+	fs.DurationVar(&flags.spoolInterval, "spool-interval", time.Minute, "How often spooled mail is retried")
+	fs.DurationVar(&flags.shutdownTimeout, "shutdown-timeout", 30*time.Second, `How long to wait for SMTP sessions and queued deliveries to finish on SIGTERM or SIGINT.
+Queued mail still undelivered after this is written to --spool-dir`)
+	fs.StringVar(&flags.metricsListen, "metrics-listen", "", "Address to serve metrics (expvar JSON) on at /debug/vars, eg 127.0.0.1:9925, disabled by default")
+	fs.IntVar(&flags.listenPort, "port", 1025, "Port to listen on")
+	fs.Var(&flags.templateEnv, "template-env", `Environment variable templates may read with env or expandenv, may be given multiple times.
+A trailing "*" allows every variable with that prefix, eg "PIGEON_*". Templates may read none by default`)
+	fs.StringVar(&flags.templateDir, "template-dir", "", `Directory of templates parsed together, so any template may include another with {{template "name" .}}.
+Each file is a template named after its file name, and may define more. --template-name picks one as the body`)
+	fs.DurationVar(&flags.dedupTTL, "dedup-ttl", 0, `Accept mail already accepted within this long with "250" without delivering it again, 0 disables.
+Mail is the same when its Message-ID is, or without one its sender, subject and body`)
+	fs.StringVar(&flags.dedupKey, "dedup-key", "", `Template (sprig + env + secret) rendering what makes mail the same for --dedup-ttl instead,
+eg '{{.Sender}} {{.Header.Get "Subject"}}'`)
+	fs.Var(&flags.redact, "redact", fmt.Sprintf(`Redact text from mail before templates see it, may be given multiple times.
+A built in redaction, one of %v, or "name=regexp" to replace matches with "[name]"`, strings.Join(config.BuiltinRedactions(), ", ")))
+	fs.Var(&flags.redactHeaders, "redact-header", `Header to redact in .Header as well, eg "Subject", may be given multiple times.
+.Data, .Body, .Text and .HTML are always redacted`)
+	fs.StringVar(&flags.secretsDir, "secrets-dir", config.DefaultSecretsDir, `Directory templates read files from with secret, eg {{secret "slack-token"}}`)
+	registerEndpointFlags(fs, &flags.endpoint)
 
-	flag.BoolVar(&flags.version, "version", false, "Show version information")
-	flag.BoolVar(&flags.help, "help", false, "View this text")
-	flag.BoolVar(&flags.prefixLogger, "standalone-logging", false, "Prefix logs with date and time")
+	return &flags, fs
+}
 
-	flag.StringVar(&flags.mailDomain, "domain", "localhost", "Mail domain to reply to EHLO with")
-	flag.StringVar(&flags.listenHost, "host", "127.0.0.1", "Address to bind to")
-	flag.Var(&flags.endpointHeaders, "header", `Headers to attach to POST.
+// registerEndpointFlags adds the endpoint options to fs, defaulting to the
+// values already in e.
+func registerEndpointFlags(fs *flag.FlagSet, e *endpointFlags) {
+	fs.Var(&e.headers, "header", `Headers to attach to POST.
 Must be in form "Header: Value" and may be given multiple times.
 Values may be templated (sprig + env) but header name must be a plain string postfixed by ":"`)
-	flag.IntVar(&flags.listenPort, "port", 1025, "Port to listen on")
-	flag.StringVar(&flags.endpointURL, "url", "", "URL to make HTTP POST to, required, may be templated (sprig + env)")
-	flag.StringVar(
-		&flags.templateString,
+	fs.StringVar(&e.http.Method, "method", e.http.Method, "HTTP method to use for http(s) URLs, one of POST, PUT or PATCH")
+	fs.DurationVar(&e.http.Timeout, "timeout", e.http.Timeout, "Maximum time for an HTTP request to complete, including reading the response, 0 for none")
+	fs.DurationVar(&e.http.ConnectTimeout, "connect-timeout", e.http.ConnectTimeout, "Maximum time to establish an HTTP connection, 0 for none")
+	fs.IntVar(&e.http.MaxRedirects, "max-redirects", e.http.MaxRedirects, "Number of HTTP redirects to follow, 0 to treat redirects as the final response")
+	fs.Int64Var(&e.http.MaxResponseBytes, "max-response-bytes", e.http.MaxResponseBytes, "Maximum bytes of an HTTP response body to read, and log when the endpoint rejects a message")
+	fs.BoolVar(&e.http.ParseResponseJSON, "parse-response-json", e.http.ParseResponseJSON, "Parse JSON HTTP responses so later deliveries of the same message can use them via .Responses")
+	fs.StringVar(&e.http.Compression, "compress", e.http.Compression, "Compress HTTP request bodies with gzip or zstd, for endpoints that accept Content-Encoding")
+	fs.IntVar(&e.http.CompressAbove, "compress-above", e.http.CompressAbove, "Only compress HTTP request bodies larger than this many bytes")
+	fs.StringVar(&e.http.Proxy, "proxy", e.http.Proxy, `Proxy URL for http(s) endpoints, http://, https://, socks5:// or socks5h://.
+Defaults to the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables, "direct" disables proxying`)
+	fs.StringVar(&e.http.CAFile, "tls-ca", e.http.CAFile, "PEM CA bundle used to verify https endpoints instead of the system roots")
+	fs.StringVar(&e.http.CertFile, "tls-cert", e.http.CertFile, "PEM client certificate to present to https endpoints, requires --tls-key")
+	fs.StringVar(&e.http.KeyFile, "tls-key", e.http.KeyFile, "PEM private key for --tls-cert")
+	fs.StringVar(&e.http.MinTLSVersion, "tls-min-version", e.http.MinTLSVersion, "Minimum TLS version for https endpoints, one of 1.0, 1.1, 1.2 or 1.3")
+	fs.Var((*stringSlice)(&e.http.PinnedSPKI), "tls-pin", `Base64 SHA-256 digest of a trusted certificate public key (SPKI), optionally prefixed by "sha256/".
+May be given multiple times, connections must present at least one pinned key.`)
+	fs.StringVar(&e.signing.SecretFile, "sign-secret-file", e.signing.SecretFile, "File containing the secret used to HMAC sign request bodies, enables signing")
+	fs.StringVar(&e.signing.SecretEnv, "sign-secret-env", e.signing.SecretEnv, "Environment variable containing the secret used to HMAC sign request bodies, enables signing")
+	fs.StringVar(&e.signing.Style, "sign-style", e.signing.Style, `Signature style, "stripe" sends "t=timestamp,v1=hmac(timestamp.body)",
+"github" sends "sha256=hmac(body)"`)
+	fs.StringVar(&e.signing.Algorithm, "sign-algorithm", e.signing.Algorithm, "Signature HMAC algorithm, sha256 or sha512")
+	fs.StringVar(&e.signing.Header, "sign-header", e.signing.Header, `Header to send the signature in, defaults to "X-Signature" for the stripe style
+and "X-Hub-Signature-256" (or -512) for the github style`)
+	fs.StringVar(&e.signing.TimestampHeader, "sign-timestamp-header", e.signing.TimestampHeader, "Header to also send the signing timestamp in, optional")
+	fs.StringVar(&e.oauth.TokenURL, "oauth-token-url", e.oauth.TokenURL, "OAuth2 token URL, enables the client credentials grant and sends \"Authorization: Bearer\"")
+	fs.StringVar(&e.oauth.ClientID, "oauth-client-id", e.oauth.ClientID, "OAuth2 client ID")
+	fs.StringVar(&e.oauth.ClientSecretFile, "oauth-client-secret-file", e.oauth.ClientSecretFile, "File containing the OAuth2 client secret")
+	fs.StringVar(&e.oauth.ClientSecretEnv, "oauth-client-secret-env", e.oauth.ClientSecretEnv, "Environment variable containing the OAuth2 client secret")
+	fs.Var((*stringSlice)(&e.oauth.Scopes), "oauth-scope", "OAuth2 scope to request, may be given multiple times")
+	fs.DurationVar(&e.oauth.RefreshBefore, "oauth-refresh-before", e.oauth.RefreshBefore, "Fetch a new OAuth2 token this long before the current one expires")
+	fs.IntVar(&e.breaker.Threshold, "breaker-threshold", e.breaker.Threshold, `Consecutive delivery failures (connection errors, 5xx or 429 responses) before an endpoint's circuit breaker opens.
+While open, mail is spooled, or refused with "451 4.4.1" without --spool-dir, without contacting the endpoint, 0 disables`)
+	fs.DurationVar(&e.breaker.OpenFor, "breaker-open-for", e.breaker.OpenFor, "How long a circuit breaker stays open before a single probe delivery is attempted")
+	fs.Float64Var(&e.rateLimit.PerSecond, "rate-limit", e.rateLimit.PerSecond, "Maximum deliveries per second to each endpoint, extra deliveries wait their turn, 0 disables")
+	fs.IntVar(&e.rateLimit.Burst, "rate-burst", e.rateLimit.Burst, "Deliveries that may be made at once before --rate-limit applies")
+	fs.IntVar(&e.rateLimit.MaxQueue, "rate-queue", e.rateLimit.MaxQueue, "Maximum deliveries waiting on each endpoint's rate limit")
+	fs.StringVar(&e.rateLimit.Overflow, "rate-overflow", e.rateLimit.Overflow, `What to do with mail when the rate limit queue is full.
+"tempfail" refuses it with "451 4.7.0", "spool" writes it to --spool-dir for later delivery, "drop" accepts and logs it`)
+	fs.Var(&e.syslogSeverity, "syslog-severity", `Severity for syslog and journald URLs when the subject matches a pattern.
+Must be in form "severity=regexp", eg "err=(?i)failed", and may be given multiple times.
+The first matching rule wins, otherwise the URL "severity" parameter is used.`)
+	fs.StringVar(&e.url, "url", e.url, `URL to deliver to, required unless --config has routes, may be templated (sprig + env).
+http(s):// URLs receive a POST, as do unix:///path/to.sock:/http/path URLs, nats://, mqtt(s):// and redis(s):// URLs are
+published to the subject, topic or stream named by the URL path.
+syslog+udp://, syslog+tcp://, syslog+tls://, syslog+unix:// and journald://
+URLs log one entry per message.`)
+	fs.StringVar(
+		&e.template,
 		"template",
-		defaultTemplate,
-		`Template (sprig + env) used to render POST body.
+		e.template,
+		`Template (sprig + env + secret) used to render POST body.
 Does not have to be JSON if you set the appropriate Content-Type header.
 Can access:
   - ID         string
   - Timestamp  time.Time
   - Sender     string
   - Recipients []string
+  - Recipient  {Address, Local, Domain string}
   - Data       string
   - Header     mail.Header
   - Body       string
+  - Text, HTML string, the decoded text/plain and text/html parts
+  - Responses  []{Status int, Header http.Header, Body string, JSON any}
+  - Vars       map[string]string, set by --config rules
+  - Redactions int, how many values --redact replaced
 `)
-
-	flag.Parse()
-
-	return &flags
+	fs.StringVar(&e.templateFile, "template-file", e.templateFile, "File to read --template from instead")
+	fs.StringVar(&e.templateName, "template-name", e.templateName, "Template from --template-dir to use instead of --template")
 }
 
 func configureLog(prefix bool) {
@@ -84,18 +235,46 @@ func configureLog(prefix bool) {
 	}
 }
 
+// dryrun delivers a sample message through every route, with every endpoint
+// pointed at a fake server, to check the templates render.
 func dryrun(cfg *config.Config) error {
+	if err := checkTemplates(cfg); err != nil {
+		return err
+	}
+
 	// run fake endpoint
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 	}))
 	defer server.Close()
 
 	// mostly use the real config, just point it at our fake server
-	url := cfg.URL
-	var err error
-	cfg.URL, err = template.New("mock").Parse(server.URL)
-
-	log.SetOutput(io.Discard)
+	mockURL, err := template.New("mock").Parse(server.URL)
+	if err != nil {
+		return err
+	}
+	mock := *cfg
+	mock.Endpoint = *mockEndpoint(&cfg.Endpoint, mockURL)
+	mock.Queue = nil
+	// the sample would be remembered, and suppressed by the next reload
+	mock.Dedup = nil
+	// every route is rendered anyway, and route-to rules use the real endpoints
+	mock.Rules = nil
+	// keep quiet without silencing sessions running while we reload
+	mock.Log = log.New(io.Discard, "", 0)
+	mock.Routes = nil
+	var batched [][]config.Target
+	for _, route := range cfg.Routes {
+		// match everything and carry on so every route is rendered
+		r := &config.Route{Name: route.Name, Template: route.Template, Continue: true}
+		for _, endpoint := range route.Endpoints {
+			r.Endpoints = append(r.Endpoints, mockEndpoint(endpoint, mockURL))
+		}
+		mock.Routes = append(mock.Routes, r)
+		if route.Batch != nil {
+			batch := &config.Route{Name: route.Name, Endpoints: r.Endpoints, Batch: route.Batch}
+			batched = append(batched, batch.Targets())
+		}
+	}
 
 	data := `Subject: ON MY WAY
 From: Gordon Freeman <freeman@materials.blackmesa.com>
@@ -105,53 +284,511 @@ Cc: Issac Kleiner <kleiner@materials.blackmesa.com>
 hey guys running L8 2DAY
 on the tram now`
 
-	session := session.NewSession(cfg)
-	session.Mail("freeman@mailhub.bm.net", smtp.MailOptions{})
-	session.Rcpt("vance@mailhub.bm.net")
-	session.Rcpt("kleiner@mailhub.bm.net")
-	err = session.Data(strings.NewReader(data))
+	s := session.NewSession(&mock)
+	s.Mail("freeman@mailhub.bm.net", smtp.MailOptions{})
+	s.Rcpt("vance@mailhub.bm.net")
+	s.Rcpt("kleiner@mailhub.bm.net")
+	if err := s.Data(strings.NewReader(data)); err != nil {
+		return err
+	}
+
+	// batches of two, so templates see more than one message
+	msg := &spool.Message{
+		ID:         "dryrun",
+		Timestamp:  time.Now(),
+		Sender:     "freeman@mailhub.bm.net",
+		Recipients: []string{"vance@mailhub.bm.net", "kleiner@mailhub.bm.net"},
+		Data:       data,
+	}
+	for _, targets := range batched {
+		if err := session.DeliverBatch(&mock, targets, []*spool.Message{msg, msg}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mockEndpoint copies the endpoint, pointed at the fake server. Nothing that
+// would send the request, or a token request, elsewhere is kept, and it is
+// renamed so it doesn't share the real endpoint's clients. OAuth options were
+// validated when they were built.
+func mockEndpoint(endpoint *config.Endpoint, url *template.Template) *config.Endpoint {
+	e := *endpoint
+	e.Name = config.DryRunPrefix + e.Name
+	e.URL = url
+	// breakers and limits are kept per server, the fake one would add new
+	// ones on every reload
+	e.Breaker = nil
+	e.RateLimit = nil
+	e.OAuth = nil
+	if e.HTTP != nil {
+		opts := *e.HTTP
+		opts.Proxy = "direct"
+		opts.CAFile, opts.CertFile, opts.KeyFile = "", "", ""
+		opts.PinnedSPKI = nil
+		e.HTTP = &opts
+	}
+	return &e
+}
+
+// checkTemplates makes sure every template the body templates could include
+// exists, even in branches a sample message doesn't reach.
+func checkTemplates(cfg *config.Config) error {
+	templates := []*template.Template{cfg.Template}
+	if cfg.Dedup != nil && cfg.Dedup.Key != nil {
+		templates = append(templates, cfg.Dedup.Key)
+	}
+	for _, route := range cfg.Routes {
+		if route.Template != nil {
+			templates = append(templates, route.Template)
+		}
+		for _, endpoint := range route.Endpoints {
+			templates = append(templates, endpoint.Template)
+		}
+	}
+	for _, tmpl := range templates {
+		if err := config.CheckTemplates(tmpl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errNoURL is returned by loadConfig when there is nowhere to deliver to
+var errNoURL = errors.New("Must provide --url option")
+
+// loadConfig applies the environment and config file to the parsed flags and
+// builds the configuration. The command line overrides the environment, which
+// overrides the file.
+func loadConfig(fs *flag.FlagSet, flags *flags) (*config.Config, *config.File, error) {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	if err := loadEnv(fs, given); err != nil {
+		return nil, nil, err
+	}
+	file, err := loadFile(fs, flags, given)
+	if err != nil {
+		return nil, nil, err
+	}
+	if flags.async && (flags.workers < 1 || flags.queueDepth < 0) {
+		return nil, nil, fmt.Errorf("--workers must be at least 1 and --queue-depth must not be negative")
+	}
+	cfg, err := buildConfig(flags, file)
+	if err != nil {
+		return nil, nil, err
+	}
+	if flags.endpoint.url == "" && len(cfg.Routes) == 0 {
+		return nil, nil, errNoURL
+	}
+	return cfg, file, nil
+}
+
+// loadEnv applies SMTP_PIGEON_* variables to any flags not in given, and adds
+// the flags it sets to given.
+func loadEnv(fs *flag.FlagSet, given map[string]bool) error {
+	options, unknown, err := config.EnvOptions(os.Environ(), func(name string) (bool, bool) {
+		f := fs.Lookup(name)
+		if f == nil || commandLineOnly[name] {
+			return false, false
+		}
+		_, repeatable := f.Value.(*stringSlice)
+		return true, repeatable
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range unknown {
+		log.Printf("Ignoring %v, it is not an option", key)
+	}
+	if err := applyOptions(fs, options, given); err != nil {
+		return err
+	}
+	for _, opt := range options {
+		given[opt.Name] = true
+	}
+	return nil
+}
+
+// loadFile reads --config, if given, and applies its options to any flags not
+// in given.
+func loadFile(fs *flag.FlagSet, flags *flags, given map[string]bool) (*config.File, error) {
+	if flags.configFile == "" {
+		return nil, nil
+	}
+	file, err := config.LoadFile(flags.configFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range file.Options {
+		if opt.Name == "config" {
+			return nil, opt.Errorf("unknown option %q", opt.Name)
+		}
+	}
+	if err := applyOptions(fs, file.Options, given); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// applyOptions sets flags in fs, skipping any named in skip. Repeatable flags
+// are replaced by the options' values rather than added to.
+func applyOptions(fs *flag.FlagSet, options []config.Option, skip map[string]bool) error {
+	for _, opt := range options {
+		if skip[opt.Name] {
+			continue
+		}
+		f := fs.Lookup(opt.Name)
+		if f == nil || commandLineOnly[opt.Name] {
+			return opt.Errorf("unknown option %q", opt.Name)
+		}
+		if list, ok := f.Value.(*stringSlice); ok {
+			*list = nil
+		} else if len(opt.Values) != 1 {
+			return opt.Errorf("%v takes a single value", opt.Name)
+		}
+		for _, value := range opt.Values {
+			if err := fs.Set(opt.Name, value); err != nil {
+				return opt.Errorf("invalid value %q for %v: %v", value, opt.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// buildConfig creates the configuration from the flags and the config file's
+// endpoints and routes, file may be nil.
+func buildConfig(flags *flags, file *config.File) (*config.Config, error) {
+	access := &config.TemplateAccess{Env: flags.templateEnv, SecretsDir: flags.secretsDir}
+	if flags.templateDir != "" {
+		partials, err := config.LoadTemplateDir(flags.templateDir, access)
+		if err != nil {
+			return nil, err
+		}
+		access.Partials = partials
+	}
+	endpoint, err := flags.endpoint.build(config.DefaultEndpoint, access)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &config.Config{Endpoint: *endpoint}
+	if len(flags.redact) > 0 {
+		cfg.Redact, err = config.ParseRedactions(flags.redact, flags.redactHeaders)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if flags.dedupTTL != 0 {
+		cfg.Dedup = &config.DedupOptions{TTL: flags.dedupTTL}
+		if err := cfg.Dedup.Validate(); err != nil {
+			return nil, err
+		}
+		if flags.dedupKey != "" {
+			cfg.Dedup.Key, err = config.ParseTemplate("dedup-key", flags.dedupKey, access)
+			if err != nil {
+				return nil, fmt.Errorf("--dedup-key: %v", err)
+			}
+		}
+	}
+	usesSpool := flags.endpoint.rateLimit.Overflow == "spool"
+
+	if file != nil {
+		endpoints := map[string]*config.Endpoint{}
+		for _, fe := range file.Endpoints {
+			// endpoints start from the top level options, except the url
+			e := new(endpointFlags)
+			*e = flags.endpoint
+			e.url = ""
+			fs := flag.NewFlagSet(fe.Name, flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			registerEndpointFlags(fs, e)
+			if err := applyOptions(fs, fe.Options, nil); err != nil {
+				return nil, err
+			}
+			if hasOption(fe.Options, "template") && !hasOption(fe.Options, "template-file") {
+				e.templateFile = ""
+			}
+			if (hasOption(fe.Options, "template") || hasOption(fe.Options, "template-file")) && !hasOption(fe.Options, "template-name") {
+				e.templateName = ""
+			}
+			if e.url == "" {
+				return nil, file.Errorf(fe.Line, "endpoint %q has no url", fe.Name)
+			}
+			endpoint, err := e.build(fe.Name, access)
+			if err != nil {
+				return nil, file.Errorf(fe.Line, "endpoint %q: %v", fe.Name, err)
+			}
+			endpoints[fe.Name] = endpoint
+			usesSpool = usesSpool || e.rateLimit.Overflow == "spool"
+		}
+		cfg.Routes, err = file.BuildRoutes(endpoints, access)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Rules, err = file.BuildRules(cfg.Routes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, route := range cfg.Routes {
+		if route.Batch != nil && flags.spoolDir == "" {
+			return nil, fmt.Errorf("route %q: batching requires --spool-dir", route.Name)
+		}
+	}
+
+	if usesSpool && flags.spoolDir == "" {
+		return nil, fmt.Errorf("--rate-overflow spool requires --spool-dir")
+	}
+	return cfg, nil
+}
+
+func hasOption(options []config.Option, name string) bool {
+	for _, opt := range options {
+		if opt.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// build validates the options and parses the endpoint's templates
+func (e *endpointFlags) build(name string, access *config.TemplateAccess) (*config.Endpoint, error) {
+	for _, validate := range []func() error{
+		e.http.Validate,
+		e.signing.Validate,
+		e.oauth.Validate,
+		e.breaker.Validate,
+		e.rateLimit.Validate,
+	} {
+		if err := validate(); err != nil {
+			return nil, err
+		}
+	}
+	severityRules, err := config.ParseSeverityRules(e.syslogSeverity)
+	if err != nil {
+		return nil, err
+	}
+	templateString := e.template
+	if e.templateFile != "" {
+		b, err := os.ReadFile(e.templateFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read template file: %v", err)
+		}
+		templateString = string(b)
+	}
+	endpoint, err := config.NewEndpoint(name, e.url, e.headers, templateString, access)
+	if err != nil {
+		return nil, err
+	}
+	if e.templateName != "" {
+		endpoint.Template, err = config.NamedTemplate(e.templateName, access)
+		if err != nil {
+			return nil, err
+		}
+	}
+	endpoint.SeverityRules = severityRules
+	endpoint.HTTP = &e.http
+	endpoint.Signing = &e.signing
+	endpoint.OAuth = &e.oauth
+	endpoint.Breaker = &e.breaker
+	endpoint.RateLimit = &e.rateLimit
+	return endpoint, nil
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	log.Println("smtp-pigeon metrics at", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// replaySpool retries spooled mail on startup and then every interval, using
+// the backend's current configuration.
+func replaySpool(be *backend.Permissive, interval time.Duration) {
+	for {
+		cfg := be.Config()
+		remaining, err := cfg.Spool.Replay(func(msg *spool.Message) error {
+			return session.Redeliver(cfg, msg)
+		})
+		if err != nil {
+			log.Printf("Spool replay failed: %v", err)
+		} else if remaining > 0 {
+			log.Printf("Spool has %d undelivered messages", remaining)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// render prints what a message renders to for every route it matches,
+// without delivering it, and exits non-zero if any template fails.
+func render(args []string) int {
+	flags, fs := newFlags("smtp-pigeon render")
+	var messageFile, from string
+	var to stringSlice
+	fs.StringVar(&messageFile, "message", "", "Message (.eml) to render, required")
+	fs.StringVar(&from, "from", "", "Envelope sender, defaults to the message's From address")
+	fs.Var(&to, "to", "Envelope recipient, may be given multiple times, defaults to the message's To and Cc addresses")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if flags.help {
+		fs.PrintDefaults()
+		return 0
+	}
+	configureLog(flags.prefixLogger)
+	if messageFile == "" {
+		log.Println("Error: Must provide --message option")
+		return 2
+	}
+	cfg, _, err := loadConfig(fs, flags)
+	if err != nil {
+		log.Println("Error:", err)
+		return 1
+	}
+	if err := checkTemplates(cfg); err != nil {
+		log.Println("Error:", err)
+		return 1
+	}
+
+	data, err := os.ReadFile(messageFile)
+	if err != nil {
+		log.Println("Error:", err)
+		return 1
+	}
+	msg := &spool.Message{
+		ID:         uuid.New().String(),
+		Timestamp:  time.Now(),
+		Sender:     from,
+		Recipients: to,
+		Data:       string(data),
+	}
+	if err := envelopeFromHeaders(msg); err != nil {
+		log.Println("Error:", err)
+		return 1
+	}
 
-	log.SetOutput(os.Stderr)
+	previews, err := session.Render(cfg, msg)
+	if err != nil {
+		log.Println("Error:", err)
+		return 1
+	}
+	status := 0
+	for i, preview := range previews {
+		if i > 0 {
+			fmt.Println()
+		}
+		name := fmt.Sprintf("endpoint %q", preview.Target.Endpoint.Name)
+		if preview.Target.Route != "" {
+			name = fmt.Sprintf("route %q, %v", preview.Target.Route, name)
+		}
+		fmt.Printf("# %v\n", name)
+		if preview.Err != nil {
+			log.Printf("Error: %v: %v", name, preview.Err)
+			status = 1
+			continue
+		}
+		r := preview.Rendering
+		fmt.Println(strings.TrimSpace(r.Method + " " + r.URL))
+		for _, header := range r.Headers {
+			fmt.Printf("%v: %v\n", header[0], header[1])
+		}
+		fmt.Println()
+		fmt.Println(string(r.Body))
+	}
+	return status
+}
 
-	cfg.URL = url
-	return err
+// envelopeFromHeaders fills in a missing sender or recipients from the
+// message's From, To and Cc headers.
+func envelopeFromHeaders(msg *spool.Message) error {
+	message, err := mail.ReadMessage(strings.NewReader(msg.Data))
+	if err != nil {
+		return fmt.Errorf("Could not parse message: %v", err)
+	}
+	if msg.Sender == "" {
+		from, err := message.Header.AddressList("From")
+		if err != nil || len(from) == 0 {
+			return fmt.Errorf("Message has no From address, use --from")
+		}
+		msg.Sender = from[0].Address
+	}
+	if len(msg.Recipients) == 0 {
+		for _, field := range []string{"To", "Cc"} {
+			addresses, _ := message.Header.AddressList(field)
+			for _, address := range addresses {
+				msg.Recipients = append(msg.Recipients, address.Address)
+			}
+		}
+		if len(msg.Recipients) == 0 {
+			return fmt.Errorf("Message has no To or Cc addresses, use --to")
+		}
+	}
+	return nil
 }
 
 func main() {
-	flags := parseFlags()
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		os.Exit(render(os.Args[2:]))
+	}
+
+	flags, fs, err := parseFlags(os.Args[1:])
+	if err != nil {
+		// the flag set has already explained
+		os.Exit(2)
+	}
 
 	// some flags are exit or failure points
 	switch {
 	case flags.help:
-		flag.PrintDefaults()
+		fs.PrintDefaults()
 		os.Exit(0)
 	case flags.version:
 		fmt.Printf("smtp-pigeon version: %s (%s, %s, %s)\n", version, commit, builtBy, date)
 		os.Exit(0)
-	case flags.endpointURL == "":
-		log.Println("Error: Must provide --url option")
-		flag.PrintDefaults()
-		os.Exit(1)
 	}
 
 	configureLog(flags.prefixLogger)
-	config, err := config.NewConfig(
-		flags.endpointURL,
-		flags.endpointHeaders,
-		flags.templateString,
-		false,
-	)
-	if err != nil {
+	config, file, err := loadConfig(fs, flags)
+	if errors.Is(err, errNoURL) {
+		log.Println("Error:", err)
+		fs.PrintDefaults()
+		os.Exit(1)
+	} else if err != nil {
 		log.Fatalln(err)
 	}
+	// the file may change how we log
+	configureLog(flags.prefixLogger)
+	if flags.spoolDir != "" {
+		config.Spool, err = spool.NewSpool(flags.spoolDir)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
 
 	err = dryrun(config)
 	if err != nil {
 		log.Println("Dry run failed, refusing to start.")
 		log.Fatalln(err)
 	}
+	session.ResumeBatches(config)
 
 	be := backend.NewBackend(config)
+	// the dry run must deliver synchronously, so only queue after it
+	if flags.async {
+		config.Queue = queue.NewQueue(flags.workers, flags.queueDepth, func(ctx context.Context, msg *spool.Message) {
+			session.DeliverQueued(ctx, be.Config(), msg)
+		})
+	}
+	if flags.metricsListen != "" {
+		go serveMetrics(flags.metricsListen)
+	}
+	if config.Spool != nil {
+		go replaySpool(be, flags.spoolInterval)
+	}
+
 	s := smtp.NewServer(be)
 	s.Addr = fmt.Sprint(flags.listenHost, ":", flags.listenPort)
 	s.Domain = flags.mailDomain
@@ -161,10 +798,199 @@ func main() {
 	s.MaxRecipients = 50
 	s.AllowInsecureAuth = true
 
-	log.Println("smtp-pigeon listening at", s.Addr)
-	if err := s.ListenAndServe(); err != nil {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
 		log.Fatal(err)
 	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Serve(l)
+	}()
+	log.Println("smtp-pigeon listening at", s.Addr)
+
+	w := &watcher{}
+	w.watch(watchedFiles(flags, file))
+	var poll <-chan time.Time
+	if flags.watchConfig {
+		poll = time.NewTicker(2 * time.Second).C
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+	for {
+		select {
+		case err := <-serveErr:
+			log.Fatal(err)
+		case <-poll:
+			if w.changed() {
+				log.Println("Configuration files changed, reloading")
+				reload(be, flags, w)
+			}
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				log.Println("Received hangup, reloading")
+				reload(be, flags, w)
+				continue
+			}
+			log.Printf("Received %v, shutting down", sig)
+			shutdown(s, l, be, be.Config(), flags.shutdownTimeout)
+			return
+		}
+	}
+}
+
+// reload re-reads the command line, config file and templates. The new
+// configuration is only used if it passes the dry run, otherwise the running
+// one is kept. Options that only take effect at startup are left as they are.
+func reload(be *backend.Permissive, running *flags, w *watcher) {
+	flags, fs, err := parseFlags(os.Args[1:])
+	if err != nil {
+		log.Printf("Reload failed, keeping the running configuration: %v", err)
+		return
+	}
+	cfg, file, err := loadConfig(fs, flags)
+	if err != nil {
+		log.Printf("Reload failed, keeping the running configuration: %v", err)
+		return
+	}
+	if err := dryrun(cfg); err != nil {
+		log.Printf("Reload dry run failed, keeping the running configuration: %v", err)
+		return
+	}
+	for _, name := range restartOptions(running, flags) {
+		log.Printf("--%v changed, restart to apply it", name)
+	}
+	keepRestartOptions(flags, running)
+	*running = *flags
+	old := be.Config()
+	cfg.Spool = old.Spool
+	cfg.Queue = old.Queue
+	be.SetConfig(cfg)
+	session.ResumeBatches(cfg)
+	w.watch(watchedFiles(flags, file))
+	log.Println("Configuration reloaded")
+}
+
+// restartOptions lists the options that differ between a and b but can't be
+// changed by a reload.
+func restartOptions(a *flags, b *flags) []string {
+	var changed []string
+	for _, option := range []struct {
+		name    string
+		changed bool
+	}{
+		{"standalone-logging", a.prefixLogger != b.prefixLogger},
+		{"domain", a.mailDomain != b.mailDomain},
+		{"host", a.listenHost != b.listenHost},
+		{"port", a.listenPort != b.listenPort},
+		{"async", a.async != b.async},
+		{"workers", a.workers != b.workers},
+		{"queue-depth", a.queueDepth != b.queueDepth},
+		{"spool-dir", a.spoolDir != b.spoolDir},
+		{"spool-interval", a.spoolInterval != b.spoolInterval},
+		{"metrics-listen", a.metricsListen != b.metricsListen},
+		{"shutdown-timeout", a.shutdownTimeout != b.shutdownTimeout},
+		{"watch-config", a.watchConfig != b.watchConfig},
+	} {
+		if option.changed {
+			changed = append(changed, option.name)
+		}
+	}
+	return changed
+}
+
+// keepRestartOptions copies the options restartOptions lists from running to
+// reloaded, they stay as they were until a restart.
+func keepRestartOptions(reloaded *flags, running *flags) {
+	reloaded.prefixLogger = running.prefixLogger
+	reloaded.mailDomain = running.mailDomain
+	reloaded.listenHost = running.listenHost
+	reloaded.listenPort = running.listenPort
+	reloaded.async = running.async
+	reloaded.workers = running.workers
+	reloaded.queueDepth = running.queueDepth
+	reloaded.spoolDir = running.spoolDir
+	reloaded.spoolInterval = running.spoolInterval
+	reloaded.metricsListen = running.metricsListen
+	reloaded.shutdownTimeout = running.shutdownTimeout
+	reloaded.watchConfig = running.watchConfig
+}
+
+// watchedFiles are the files a reload would read again
+func watchedFiles(flags *flags, file *config.File) []string {
+	var paths []string
+	if flags.configFile != "" {
+		paths = append(paths, flags.configFile)
+	}
+	if flags.endpoint.templateFile != "" {
+		paths = append(paths, flags.endpoint.templateFile)
+	}
+	if flags.templateDir != "" {
+		// the directory changes when files are added or removed
+		paths = append(paths, flags.templateDir)
+		files, _ := config.TemplateDirFiles(flags.templateDir)
+		paths = append(paths, files...)
+	}
+	if file != nil {
+		paths = append(paths, file.TemplateFiles()...)
+	}
+	return paths
+}
+
+// watcher notices when files are modified
+type watcher struct {
+	modified map[string]time.Time
+}
+
+// watch replaces the watched files
+func (w *watcher) watch(paths []string) {
+	w.modified = map[string]time.Time{}
+	for _, path := range paths {
+		w.modified[path] = modTime(path)
+	}
+}
+
+// changed reports whether any file was modified since the last call
+func (w *watcher) changed() bool {
+	changed := false
+	for path, modified := range w.modified {
+		if t := modTime(path); !t.Equal(modified) {
+			w.modified[path] = t
+			changed = true
+		}
+	}
+	return changed
+}
+
+// modTime is zero for missing files, so removing a file counts as a change
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// shutdown stops accepting connections then waits up to timeout for open
+// sessions and queued deliveries to finish. Queued mail that is still
+// undelivered is spooled, sessions still open are disconnected and their
+// clients will retry.
+func shutdown(s *smtp.Server, l net.Listener, be *backend.Permissive, cfg *config.Config, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	l.Close()
+	if err := be.Wait(ctx); err != nil {
+		log.Printf("Sessions still open after %v, disconnecting them", timeout)
+	}
+	s.Close()
+
+	if cfg.Queue != nil {
+		for _, msg := range cfg.Queue.Drain(ctx) {
+			session.Persist(cfg, msg, msg.Pending, "Shutting down before delivery")
+		}
+	}
+	log.Println("smtp-pigeon stopped")
 }
 
 func (i *stringSlice) String() string {
@@ -1,23 +1,39 @@
 package backend
 
 import (
+	"context"
 	"github.com/emersion/go-smtp"
 	"github.com/rktjmp/smtp-pigeon/internal/config"
 	"github.com/rktjmp/smtp-pigeon/internal/session"
+	"sync"
+	"sync/atomic"
 )
 
 // Permissive backend performs no authentication checks
 type Permissive struct {
-	config *config.Config
+	config atomic.Pointer[config.Config]
+	active sync.WaitGroup
 }
 
 // NewBackend creates a New SMTP Pigeon Backend
 func NewBackend(config *config.Config) *Permissive {
-	be := Permissive{config: config}
+	be := Permissive{}
+	be.config.Store(config)
 
 	return &be
 }
 
+// Config returns the configuration new messages are delivered with
+func (backend *Permissive) Config() *config.Config {
+	return backend.config.Load()
+}
+
+// SetConfig replaces the configuration. Messages already being delivered
+// finish with the old one.
+func (backend *Permissive) SetConfig(config *config.Config) {
+	backend.config.Store(config)
+}
+
 // Login creates a new session, any username or password is accepted
 func (backend *Permissive) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
 	return backend.AnonymousLogin(state)
@@ -25,6 +41,46 @@ func (backend *Permissive) Login(state *smtp.ConnectionState, username, password
 
 // AnonymousLogin creates a new session
 func (backend *Permissive) AnonymousLogin(_state *smtp.ConnectionState) (smtp.Session, error) {
-	session := session.NewSession(backend.config)
+	backend.active.Add(1)
+	session := &trackedSession{
+		Session: session.NewSession(backend.Config()),
+		backend: backend,
+	}
 	return session, nil
 }
+
+// Wait blocks until every session has logged out or ctx is done, in which case
+// the context error is returned.
+func (backend *Permissive) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		backend.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// trackedSession marks the session finished on its first logout, go-smtp may
+// log a session out more than once.
+type trackedSession struct {
+	*session.Session
+	backend *Permissive
+	once    sync.Once
+}
+
+// Reset picks up any new configuration for the connection's next message
+func (s *trackedSession) Reset() {
+	s.Session.Reset()
+	s.Session.UseConfig(s.backend.Config())
+}
+
+func (s *trackedSession) Logout() error {
+	err := s.Session.Logout()
+	s.once.Do(s.backend.active.Done)
+	return err
+}
@@ -1,10 +1,12 @@
 package backend
 
 import (
+	"context"
 	"github.com/emersion/go-smtp"
 	"github.com/rktjmp/smtp-pigeon/internal/config"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestLogin(t *testing.T) {
@@ -24,3 +26,30 @@ func TestAnonymousLogin(t *testing.T) {
 	assert.Nil(err)
 	assert.NotNil(session)
 }
+
+func TestWait(t *testing.T) {
+	assert := assert.New(t)
+
+	be := NewBackend(&config.Config{})
+	session, _ := be.AnonymousLogin(&smtp.ConnectionState{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, be.Wait(ctx))
+
+	session.Logout()
+	session.Logout()
+	assert.Nil(be.Wait(context.Background()))
+}
+
+func TestSetConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	old := &config.Config{}
+	be := NewBackend(old)
+	assert.Same(old, be.Config())
+
+	new := &config.Config{}
+	be.SetConfig(new)
+	assert.Same(new, be.Config())
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// DefaultSecretsDir is where secret reads files from unless told otherwise
+const DefaultSecretsDir = "/run/secrets"
+
+// TemplateAccess is what templates may use from outside the message. A nil
+// TemplateAccess allows no environment variables, secrets or partials.
+type TemplateAccess struct {
+	// Env lists the environment variables env and expandenv may read, a
+	// trailing "*" allows every variable starting with what comes before it
+	Env []string
+	// SecretsDir is the directory secret reads files from
+	SecretsDir string
+	// Partials are templates body templates may include, see LoadTemplateDir
+	Partials *template.Template
+}
+
+// EnvAllowed reports whether templates may read the environment variable
+func (a *TemplateAccess) EnvAllowed(name string) bool {
+	if a == nil {
+		return false
+	}
+	for _, allowed := range a.Env {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *TemplateAccess) env(name string) (string, error) {
+	if !a.EnvAllowed(name) {
+		return "", fmt.Errorf("environment variable %q is not allowed by --template-env", name)
+	}
+	return os.Getenv(name), nil
+}
+
+func (a *TemplateAccess) expandenv(s string) (string, error) {
+	var err error
+	expanded := os.Expand(s, func(name string) string {
+		v, e := a.env(name)
+		if e != nil && err == nil {
+			err = e
+		}
+		return v
+	})
+	return expanded, err
+}
+
+// secret reads a file from SecretsDir without its trailing newline. Names
+// may not contain a path, so templates cannot read files outside it.
+func (a *TemplateAccess) secret(name string) (string, error) {
+	if a == nil || a.SecretsDir == "" {
+		return "", fmt.Errorf("secret %q: no secrets directory is set", name)
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("secret %q: must be a file name without a directory", name)
+	}
+	b, err := os.ReadFile(filepath.Join(a.SecretsDir, name))
+	if err != nil {
+		return "", fmt.Errorf("secret %q: %v", name, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// funcs returns the functions that read from the environment and secrets
+func (a *TemplateAccess) funcs() template.FuncMap {
+	return template.FuncMap{
+		"env":       a.env,
+		"expandenv": a.expandenv,
+		"secret":    a.secret,
+	}
+}
+
+// check makes sure every template in the set only reads allowed environment
+// variables, so a disallowed variable fails at startup rather than on the
+// first message. Variable names must be quoted strings for this to work.
+func (a *TemplateAccess) check(tmpl *template.Template) error {
+	return walkTemplates(tmpl, func(t *template.Template, node parse.Node) error {
+		if cmd, ok := node.(*parse.CommandNode); ok {
+			return a.checkCommand(t, cmd)
+		}
+		return nil
+	})
+}
+
+// checkCommand checks a call to env or expandenv
+func (a *TemplateAccess) checkCommand(tmpl *template.Template, cmd *parse.CommandNode) error {
+	ident, ok := cmd.Args[0].(*parse.IdentifierNode)
+	if !ok || (ident.Ident != "env" && ident.Ident != "expandenv") {
+		return nil
+	}
+	location, _ := tmpl.ErrorContext(cmd)
+	var arg *parse.StringNode
+	if len(cmd.Args) == 2 {
+		arg, _ = cmd.Args[1].(*parse.StringNode)
+	}
+	if arg == nil {
+		return fmt.Errorf("%s: %s must be given a quoted string", location, ident.Ident)
+	}
+	names := []string{arg.Text}
+	if ident.Ident == "expandenv" {
+		names = nil
+		os.Expand(arg.Text, func(name string) string {
+			names = append(names, name)
+			return ""
+		})
+	}
+	for _, name := range names {
+		if !a.EnvAllowed(name) {
+			return fmt.Errorf("%s: environment variable %q is not allowed, add --template-env %s", location, name, name)
+		}
+	}
+	return nil
+}
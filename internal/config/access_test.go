@@ -0,0 +1,83 @@
+package config_test
+
+import (
+	"bytes"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnvAllowed(t *testing.T) {
+	assert := assert.New(t)
+
+	access := &config.TemplateAccess{Env: []string{"HOME", "PIGEON_*"}}
+	assert.True(access.EnvAllowed("HOME"))
+	assert.True(access.EnvAllowed("PIGEON_HOOK"))
+	assert.False(access.EnvAllowed("HOMEDIR"))
+	assert.False(access.EnvAllowed("AWS_SECRET_ACCESS_KEY"))
+
+	var none *config.TemplateAccess
+	assert.False(none.EnvAllowed("HOME"))
+}
+
+func TestTemplateEnv(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("PIGEON_CHANNEL", "ops")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "hunter2")
+	access := &config.TemplateAccess{Env: []string{"PIGEON_*"}}
+
+	tmpl, err := config.ParseTemplate("body", `{{env "PIGEON_CHANNEL"}} {{expandenv "#$PIGEON_CHANNEL"}}`, access)
+	if assert.Nil(err) {
+		var out bytes.Buffer
+		assert.Nil(tmpl.Execute(&out, nil))
+		assert.Equal("ops #ops", out.String())
+	}
+
+	cases := []struct {
+		text string
+		err  string
+	}{
+		{`{{env "AWS_SECRET_ACCESS_KEY"}}`, `body:1:2: environment variable "AWS_SECRET_ACCESS_KEY" is not allowed, add --template-env AWS_SECRET_ACCESS_KEY`},
+		{`{{if .}}{{expandenv "${AWS_SECRET_ACCESS_KEY}"}}{{end}}`, `"AWS_SECRET_ACCESS_KEY" is not allowed`},
+		{`{{define "x"}}{{env "HOME"}}{{end}}`, `"HOME" is not allowed`},
+		{`{{.Name | env}}`, "env must be given a quoted string"},
+		{`{{printf "%s" (env .Name)}}`, "env must be given a quoted string"},
+	}
+	for _, c := range cases {
+		_, err := config.ParseTemplate("body", c.text, access)
+		if assert.NotNil(err, c.text) {
+			assert.Contains(err.Error(), c.err)
+		}
+	}
+
+	_, err = config.NewEndpoint("e", `http://{{env "HOME"}}`, nil, "", access)
+	assert.ErrorContains(err, `Could not parse url: url-template:1:9: environment variable "HOME" is not allowed`)
+	_, err = config.NewEndpoint("e", "http://localhost", []string{`X-Home: {{env "HOME"}}`}, "", access)
+	assert.ErrorContains(err, `Could not parse header`)
+}
+
+func TestTemplateSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	path := writeFile(t, "token", "s3cret\n")
+	access := &config.TemplateAccess{SecretsDir: filepath.Dir(path)}
+
+	tmpl, err := config.ParseTemplate("body", `{{secret "token"}}`, access)
+	if assert.Nil(err) {
+		var out bytes.Buffer
+		assert.Nil(tmpl.Execute(&out, nil))
+		assert.Equal("s3cret", out.String())
+	}
+
+	for _, name := range []string{"../token", "missing", ""} {
+		tmpl, err := config.ParseTemplate("body", `{{secret "`+name+`"}}`, access)
+		if assert.Nil(err) {
+			assert.NotNil(tmpl.Execute(&bytes.Buffer{}, nil), name)
+		}
+	}
+
+	tmpl, _ = config.ParseTemplate("body", `{{secret "token"}}`, nil)
+	assert.ErrorContains(tmpl.Execute(&bytes.Buffer{}, nil), "no secrets directory is set")
+}
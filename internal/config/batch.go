@@ -0,0 +1,41 @@
+package config
+
+import (
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// BatchOptions collect a route's messages and deliver them together, once
+// Window has passed since the first message or Max messages have arrived.
+type BatchOptions struct {
+	Window time.Duration
+	// Max delivers the batch early, 0 for no limit
+	Max int
+	// Template renders the batch, its data has .Messages
+	Template *template.Template
+}
+
+// Validate checks the options are usable
+func (opts *BatchOptions) Validate() error {
+	if opts.Window <= 0 {
+		return fmt.Errorf("Batch window must be positive, got %v", opts.Window)
+	}
+	if opts.Max < 0 {
+		return fmt.Errorf("Batch max must not be negative, got %d", opts.Max)
+	}
+	return nil
+}
+
+// DefaultBatchTemplateString returns the default JSON format batch template,
+// the fields of DefaultTemplateString for each message
+func DefaultBatchTemplateString() string {
+	return `{"count":{{len .Messages}},"messages":[{{range $i, $m := .Messages}}{{if $i}},{{end}}` +
+		`{"id":"{{$m.ID | js}}",` +
+		`"timestamp":"{{$m.Timestamp.UTC.Format "2006-01-02T15:04:05Z07:00" | js }}",` +
+		`"sender":"{{$m.Sender | js}}",` +
+		`"recipients":[{{range $j, $e := $m.Recipients}}{{if $j}},{{end}}"{{$e | js}}"{{end}}],` +
+		`"body":"{{$m.Body | js}}",` +
+		`"subject":"{{$m.Header.Get "Subject" | js}}"}` +
+		`{{end}}]}`
+}
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// BreakerOptions configures the circuit breaker kept for each endpoint
+type BreakerOptions struct {
+	Threshold int
+	OpenFor   time.Duration
+}
+
+// Enabled reports whether a failure threshold has been configured
+func (opts *BreakerOptions) Enabled() bool {
+	return opts != nil && opts.Threshold > 0
+}
+
+// Validate checks the options are usable
+func (opts *BreakerOptions) Validate() error {
+	if opts.Threshold < 0 {
+		return fmt.Errorf("Circuit breaker threshold must not be negative, got %d", opts.Threshold)
+	}
+	if opts.Enabled() && opts.OpenFor <= 0 {
+		return fmt.Errorf("Circuit breaker open duration must be positive, got %v", opts.OpenFor)
+	}
+	return nil
+}
@@ -3,9 +3,15 @@ package config
 import (
 	"fmt"
 	"github.com/Masterminds/sprig/v3"
-	"os"
+	"github.com/rktjmp/smtp-pigeon/internal/queue"
+	"github.com/rktjmp/smtp-pigeon/internal/spool"
+	"log"
+	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
 	"text/template"
+	"time"
 )
 
 type HeaderPair struct {
@@ -13,52 +19,134 @@ type HeaderPair struct {
 	Value *template.Template
 }
 
-// Config contains operatonal configuration values
+// Config contains operatonal configuration values. The embedded Endpoint is
+// where messages are delivered when there are no Routes.
 type Config struct {
-	Verbose  bool
-	URL      *template.Template
-	Headers  []HeaderPair
-	Template *template.Template
+	Endpoint
+	Verbose bool
+	Routes  []*Route
+	Rules   []*Rule
+	Spool   *spool.Spool
+	Queue   *queue.Queue
+	Dedup   *DedupOptions
+	Redact  *RedactOptions
+	// Log is used for session logs, the standard logger if nil
+	Log *log.Logger
+}
+
+// Logger returns Log, or the standard logger when the config or Log is nil
+func (c *Config) Logger() *log.Logger {
+	if c != nil && c.Log != nil {
+		return c.Log
+	}
+	return log.Default()
+}
+
+// DefaultEndpoint names the endpoint set by the top level options. State
+// shared between messages is kept per endpoint name, so endpoints in a config
+// file can't use it, or start with DryRunPrefix which the dry run's copies of
+// every endpoint do.
+const (
+	DefaultEndpoint = "default"
+	DryRunPrefix    = "dryrun-"
+)
+
+// Endpoint is somewhere messages are delivered and how to deliver them
+type Endpoint struct {
+	Name          string
+	URL           *template.Template
+	Headers       []HeaderPair
+	Template      *template.Template
+	SeverityRules []SeverityRule
+	HTTP          *HTTPOptions
+	Signing       *SigningOptions
+	OAuth         *OAuthOptions
+	Breaker       *BreakerOptions
+	RateLimit     *RateLimitOptions
 }
 
 // NewConfig creates an SMTP Pigeon configuration struct
 func NewConfig(urlString string, headerArgs []string, templateString string, verbose bool) (*Config, error) {
-	var headers []HeaderPair
-	var urlTemplate *template.Template
-	var bodyTemplate *template.Template
-	var err error
-
-	funcs := sprig.TxtFuncMap()
-	funcs["env"] = os.Getenv
+	endpoint, err := NewEndpoint(DefaultEndpoint, urlString, headerArgs, templateString, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{
+		Endpoint: *endpoint,
+		Verbose:  verbose,
+	}, nil
+}
 
-	headers, err = headerStringsToPairs(headerArgs)
+// NewEndpoint parses the endpoint's URL, header and body templates, other
+// options are left for the caller to set. Access limits what the templates
+// may read from the environment and secrets.
+func NewEndpoint(name string, urlString string, headerArgs []string, templateString string, access *TemplateAccess) (*Endpoint, error) {
+	headers, err := headerStringsToPairs(headerArgs, access)
 	if err != nil {
 		return nil, err
 	}
 
-	urlTemplate, err = template.New("url-template").Funcs(funcs).Parse(urlString)
+	urlTemplate, err := template.New("url-template").Funcs(funcMap(access)).Parse(urlString)
+	if err == nil {
+		err = access.check(urlTemplate)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Could not parse url: %v", err)
 	}
 
-	bodyTemplate, err = template.New("post-template").Funcs(funcs).Parse(templateString)
+	bodyTemplate, err := ParseTemplate("post-template", templateString, access)
 	if err != nil {
-		return nil, fmt.Errorf("Could not parse template: %v", err)
+		return nil, err
 	}
 
-	return &Config{
-		Verbose:  verbose,
+	return &Endpoint{
+		Name:     name,
 		URL:      urlTemplate,
 		Headers:  headers,
 		Template: bodyTemplate,
 	}, nil
 }
 
-func headerStringsToPairs(headerArgs []string) ([]HeaderPair, error) {
+// ParseTemplate parses a body template with the sprig, env and secret
+// functions, it may include any of access's partials
+func ParseTemplate(name string, text string, access *TemplateAccess) (*template.Template, error) {
+	var tmpl *template.Template
+	if access != nil && access.Partials != nil {
+		set, err := access.Partials.Clone()
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse template: %v", err)
+		}
+		tmpl = set.New(name)
+	} else {
+		tmpl = template.New(name).Funcs(funcMap(access))
+	}
+	tmpl, err := tmpl.Parse(text)
+	if err == nil {
+		err = access.check(tmpl)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// funcMap returns the functions available to every template, sprig's env
+// and expandenv are replaced by ones limited to what access allows
+func funcMap(access *TemplateAccess) template.FuncMap {
+	funcs := sprig.TxtFuncMap()
+	for name, fn := range textFuncs() {
+		funcs[name] = fn
+	}
+	for name, fn := range access.funcs() {
+		funcs[name] = fn
+	}
+	return funcs
+}
+
+func headerStringsToPairs(headerArgs []string, access *TemplateAccess) ([]HeaderPair, error) {
 	var re = regexp.MustCompile(`(.+):\s*(.+)`)
 	var headers []HeaderPair
-	funcs := sprig.TxtFuncMap()
-	funcs["env"] = os.Getenv
+	funcs := funcMap(access)
 	for _, arg := range headerArgs {
 		match := re.FindStringSubmatch(arg)
 		if len(match) == 0 {
@@ -66,6 +154,9 @@ func headerStringsToPairs(headerArgs []string) ([]HeaderPair, error) {
 		}
 		key := match[1]
 		valueTemplate, err := template.New("header-template").Funcs(funcs).Parse(match[2])
+		if err == nil {
+			err = access.check(valueTemplate)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("Could not parse header: %v", err)
 		}
@@ -87,3 +178,137 @@ func DefaultTemplateString() string {
 		`"body":"{{.Body | js}}",` +
 		`"subject":"{{.Header.Get "Subject"}}"}`
 }
+
+// SeverityRule assigns a syslog severity to messages whose subject matches
+type SeverityRule struct {
+	Severity int
+	Pattern  *regexp.Regexp
+}
+
+var severities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// ParseSeverity converts a syslog severity name, eg "warning", to its numeric
+// value.
+func ParseSeverity(name string) (int, error) {
+	for i, s := range severities {
+		if s == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown syslog severity %q, must be one of %v", name, severities)
+}
+
+// SeverityName converts a numeric syslog severity to its name.
+func SeverityName(severity int) string {
+	return severities[severity]
+}
+
+// ParseSeverityRules converts "severity=pattern" strings into rules, in order.
+func ParseSeverityRules(ruleArgs []string) ([]SeverityRule, error) {
+	var rules []SeverityRule
+	for _, arg := range ruleArgs {
+		name, pattern, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("Syslog severity rules must be in the format `severity=pattern`, got %q", arg)
+		}
+		severity, err := ParseSeverity(name)
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse syslog severity pattern: %v", err)
+		}
+		rules = append(rules, SeverityRule{Severity: severity, Pattern: re})
+	}
+	return rules, nil
+}
+
+// HTTPOptions configures requests made to http(s) endpoints
+type HTTPOptions struct {
+	Method            string
+	Timeout           time.Duration
+	ConnectTimeout    time.Duration
+	MaxRedirects      int
+	MaxResponseBytes  int64
+	CAFile            string
+	CertFile          string
+	KeyFile           string
+	MinTLSVersion     string
+	PinnedSPKI        []string
+	Proxy             string
+	Compression       string
+	CompressAbove     int
+	ParseResponseJSON bool
+}
+
+// DefaultHTTPOptions returns the options used when none are configured
+func DefaultHTTPOptions() *HTTPOptions {
+	return &HTTPOptions{
+		Method:           "POST",
+		Timeout:          30 * time.Second,
+		ConnectTimeout:   10 * time.Second,
+		MaxRedirects:     10,
+		MaxResponseBytes: 64 * 1024,
+		MinTLSVersion:    "1.2",
+		CompressAbove:    64 * 1024,
+	}
+}
+
+// Validate checks the options are usable, the method is normalised to upper
+// case.
+func (opts *HTTPOptions) Validate() error {
+	opts.Method = strings.ToUpper(opts.Method)
+	switch opts.Method {
+	case "POST", "PUT", "PATCH":
+	default:
+		return fmt.Errorf("HTTP method must be one of POST, PUT or PATCH, got %q", opts.Method)
+	}
+	if opts.Timeout < 0 || opts.ConnectTimeout < 0 {
+		return fmt.Errorf("HTTP timeouts must not be negative")
+	}
+	if opts.MaxRedirects < 0 {
+		return fmt.Errorf("HTTP max redirects must not be negative, got %d", opts.MaxRedirects)
+	}
+	if opts.MaxResponseBytes < 0 {
+		return fmt.Errorf("HTTP max response bytes must not be negative, got %d", opts.MaxResponseBytes)
+	}
+	if _, err := opts.TLSConfig(); err != nil {
+		return err
+	}
+	if _, err := opts.ProxyFunc(); err != nil {
+		return err
+	}
+	opts.Compression = strings.ToLower(opts.Compression)
+	switch opts.Compression {
+	case "", "gzip", "zstd":
+	default:
+		return fmt.Errorf("HTTP compression must be gzip or zstd, got %q", opts.Compression)
+	}
+	if opts.CompressAbove < 0 {
+		return fmt.Errorf("HTTP compression threshold must not be negative, got %d", opts.CompressAbove)
+	}
+	return nil
+}
+
+// ProxyFunc returns the proxy selection function for the options. With no
+// proxy configured the standard HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables are used, "direct" disables proxying entirely.
+func (opts *HTTPOptions) ProxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	switch opts.Proxy {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "direct":
+		return nil, nil
+	}
+	proxy, err := url.Parse(opts.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse proxy URL: %v", err)
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("Proxy URL scheme must be http, https, socks5 or socks5h, got %q", proxy.Scheme)
+	}
+	return http.ProxyURL(proxy), nil
+}
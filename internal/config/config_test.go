@@ -1,6 +1,7 @@
 package config_test
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"github.com/emersion/go-smtp"
 	"github.com/rktjmp/smtp-pigeon/internal/config"
@@ -10,6 +11,8 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -71,3 +74,164 @@ on the tram now`
 	err := session.Data(strings.NewReader(data))
 	assert.Nil(err)
 }
+
+func TestParseSeverityRules(t *testing.T) {
+	assert := assert.New(t)
+
+	rules, err := config.ParseSeverityRules([]string{"err=(?i)failed", "warning=WARN"})
+	assert.Nil(err)
+	assert.Equal(2, len(rules))
+	assert.Equal(3, rules[0].Severity)
+	assert.True(rules[0].Pattern.MatchString("Backup Failed"))
+	assert.Equal("warning", config.SeverityName(rules[1].Severity))
+
+	_, err = config.ParseSeverityRules([]string{"err"})
+	assert.NotNil(err)
+
+	_, err = config.ParseSeverityRules([]string{"bad=FAILED"})
+	assert.NotNil(err)
+
+	_, err = config.ParseSeverityRules([]string{"err=("})
+	assert.NotNil(err)
+}
+
+func TestHTTPOptionsValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := config.DefaultHTTPOptions()
+	assert.Nil(opts.Validate())
+
+	opts.Method = "patch"
+	assert.Nil(opts.Validate())
+	assert.Equal("PATCH", opts.Method)
+
+	opts.Method = "GET"
+	assert.NotNil(opts.Validate())
+
+	opts = config.DefaultHTTPOptions()
+	opts.MaxRedirects = -1
+	assert.NotNil(opts.Validate())
+}
+
+func TestHTTPOptionsTLSConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := config.DefaultHTTPOptions()
+	opts.MinTLSVersion = "1.3"
+	cfg, err := opts.TLSConfig()
+	assert.Nil(err)
+	assert.Equal(uint16(tls.VersionTLS13), cfg.MinVersion)
+
+	opts.MinTLSVersion = "2.0"
+	assert.NotNil(opts.Validate())
+
+	opts = config.DefaultHTTPOptions()
+	opts.CAFile = "/does/not/exist"
+	assert.NotNil(opts.Validate())
+
+	opts = config.DefaultHTTPOptions()
+	opts.CertFile = "cert-without-key.pem"
+	assert.NotNil(opts.Validate())
+
+	opts = config.DefaultHTTPOptions()
+	opts.PinnedSPKI = []string{"sha256/not-a-digest"}
+	assert.NotNil(opts.Validate())
+}
+
+func TestSigningOptionsValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	var opts *config.SigningOptions
+	assert.False(opts.Enabled())
+
+	opts = &config.SigningOptions{Style: "stripe", Algorithm: "sha256"}
+	assert.False(opts.Enabled())
+	assert.Nil(opts.Validate(), "disabled signing is valid")
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secretFile, []byte("shh\n"), 0600)
+	opts = &config.SigningOptions{Style: "GitHub", Algorithm: "sha512", SecretFile: secretFile}
+	assert.Nil(opts.Validate())
+	assert.Equal("X-Hub-Signature-512", opts.Header)
+	secret, _ := opts.Secret()
+	assert.Equal("shh", string(secret), "trailing newline is trimmed")
+
+	opts = &config.SigningOptions{Style: "stripe", Algorithm: "md5", SecretFile: secretFile}
+	assert.NotNil(opts.Validate())
+
+	opts = &config.SigningOptions{Style: "stripe", Algorithm: "sha256", SecretEnv: "PIGEON_UNSET_SECRET"}
+	assert.NotNil(opts.Validate(), "empty secret")
+}
+
+func TestOAuthOptionsValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := &config.OAuthOptions{}
+	assert.False(opts.Enabled())
+	assert.Nil(opts.Validate())
+
+	t.Setenv("PIGEON_TEST_CLIENT_SECRET", "shh")
+	opts = &config.OAuthOptions{TokenURL: "https://auth/token", ClientID: "id", ClientSecretEnv: "PIGEON_TEST_CLIENT_SECRET"}
+	assert.Nil(opts.Validate())
+
+	opts.ClientID = ""
+	assert.NotNil(opts.Validate(), "client id required")
+
+	opts = &config.OAuthOptions{TokenURL: "auth/token", ClientID: "id", ClientSecretEnv: "PIGEON_TEST_CLIENT_SECRET"}
+	assert.NotNil(opts.Validate(), "token url must be absolute")
+	opts.TokenURL = "ftp://auth/token"
+	assert.NotNil(opts.Validate(), "token url must be http(s)")
+
+	opts = &config.OAuthOptions{TokenURL: "https://auth/token", ClientID: "id"}
+	assert.NotNil(opts.Validate(), "secret required")
+}
+
+func TestHTTPOptionsProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := config.DefaultHTTPOptions()
+	proxy, err := opts.ProxyFunc()
+	assert.Nil(err)
+	assert.NotNil(proxy, "uses environment by default")
+
+	opts.Proxy = "direct"
+	proxy, err = opts.ProxyFunc()
+	assert.Nil(err)
+	assert.Nil(proxy)
+
+	opts.Proxy = "socks5://localhost:1080"
+	assert.Nil(opts.Validate())
+
+	opts.Proxy = "ftp://localhost"
+	assert.NotNil(opts.Validate())
+}
+
+func TestHTTPOptionsCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := config.DefaultHTTPOptions()
+	opts.Compression = "ZSTD"
+	assert.Nil(opts.Validate())
+	assert.Equal("zstd", opts.Compression)
+
+	opts.Compression = "brotli"
+	assert.NotNil(opts.Validate())
+}
+
+func TestRateLimitOptionsValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := &config.RateLimitOptions{}
+	assert.False(opts.Enabled())
+	assert.Nil(opts.Validate())
+
+	opts = &config.RateLimitOptions{PerSecond: 1, Burst: 5, MaxQueue: 10, Overflow: "Spool"}
+	assert.Nil(opts.Validate())
+	assert.Equal("spool", opts.Overflow)
+
+	opts.Overflow = "explode"
+	assert.NotNil(opts.Validate())
+
+	opts = &config.RateLimitOptions{PerSecond: 1, Burst: 0, Overflow: "drop"}
+	assert.NotNil(opts.Validate())
+}
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// DedupOptions suppress messages whose fingerprint was already accepted
+// within TTL. Key renders the fingerprint, when nil it is the Message-ID
+// header or, without one, the sender, subject and body.
+type DedupOptions struct {
+	TTL time.Duration
+	Key *template.Template
+}
+
+// Enabled reports whether a TTL has been configured
+func (opts *DedupOptions) Enabled() bool {
+	return opts != nil && opts.TTL > 0
+}
+
+// Validate checks the options are usable
+func (opts *DedupOptions) Validate() error {
+	if opts.TTL < 0 {
+		return fmt.Errorf("Dedup TTL must not be negative, got %v", opts.TTL)
+	}
+	return nil
+}
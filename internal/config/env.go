@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the name of every option environment variable, eg
+// --rate-limit is SMTP_PIGEON_RATE_LIMIT.
+const EnvPrefix = "SMTP_PIGEON_"
+
+// EnvOptions reads options from environ, in os.Environ form. Known reports
+// whether an option exists and whether it may be given more than once.
+// Variables with the prefix that aren't options are returned as unknown rather
+// than being an error, other programs may use the same prefix.
+//
+// Repeatable options may also be given as NAME_1, NAME_2 and so on, which are
+// used in numeric order after NAME. Any variable may end in _FILE to read its
+// value from the named file instead, without the trailing newline. Empty
+// variables are ignored.
+func EnvOptions(environ []string, known func(name string) (ok bool, repeatable bool)) (options []Option, unknown []string, err error) {
+	type value struct {
+		index  int
+		value  string
+		source string
+	}
+	values := map[string][]value{}
+	for _, kv := range environ {
+		key, v, _ := strings.Cut(kv, "=")
+		rest, ok := strings.CutPrefix(key, EnvPrefix)
+		if !ok || v == "" {
+			continue
+		}
+		name, index, fromFile, ok := envName(rest, known)
+		if !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+		if fromFile {
+			b, err := os.ReadFile(v)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", key, err)
+			}
+			v = strings.TrimRight(string(b), "\r\n")
+		}
+		values[name] = append(values[name], value{index: index, value: v, source: key})
+	}
+
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sort.Strings(unknown)
+	for _, name := range names {
+		vs := values[name]
+		sort.Slice(vs, func(i, j int) bool {
+			return vs[i].index < vs[j].index
+		})
+		opt := Option{Name: name}
+		var sources []string
+		for i, v := range vs {
+			if i > 0 && v.index == vs[i-1].index {
+				return nil, nil, fmt.Errorf("%s and %s: both set the same option", vs[i-1].source, v.source)
+			}
+			opt.Values = append(opt.Values, v.value)
+			sources = append(sources, v.source)
+		}
+		opt.Source = strings.Join(sources, ", ")
+		options = append(options, opt)
+	}
+	return options, unknown, nil
+}
+
+// envName converts the part of a variable name after the prefix to an option
+// name, the index of a repeated value and whether to read it from a file.
+func envName(name string, known func(string) (bool, bool)) (string, int, bool, bool) {
+	option := strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+	// options ending in -file, eg template-file, are matched before _FILE
+	if ok, _ := known(option); ok {
+		return option, 0, false, true
+	}
+	option, fromFile := strings.CutSuffix(option, "-file")
+	if ok, _ := known(option); ok {
+		return option, 0, fromFile, true
+	}
+	i := strings.LastIndex(option, "-")
+	if i < 0 {
+		return "", 0, false, false
+	}
+	index, err := strconv.Atoi(option[i+1:])
+	if err != nil || index < 1 {
+		return "", 0, false, false
+	}
+	if ok, repeatable := known(option[:i]); ok && repeatable {
+		return option[:i], index, fromFile, true
+	}
+	return "", 0, false, false
+}
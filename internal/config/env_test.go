@@ -0,0 +1,65 @@
+package config_test
+
+import (
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func knownOptions(name string) (bool, bool) {
+	switch name {
+	case "url", "timeout", "template-file", "sign-secret-file":
+		return true, false
+	case "header":
+		return true, true
+	}
+	return false, false
+}
+
+func TestEnvOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	secret := writeFile(t, "secret", "s3cret\n")
+	options, unknown, err := config.EnvOptions([]string{
+		"PATH=/usr/bin",
+		"SMTP_PIGEON_TIMEUOT=5s",
+		"SMTP_PIGEON_TIMEOUT_1=5s",
+		"SMTP_PIGEON_HEADER_0=A: 1",
+		"SMTP_PIGEON_URL=https://example.com",
+		"SMTP_PIGEON_TIMEOUT=",
+		"SMTP_PIGEON_HEADER_2=B: 2",
+		"SMTP_PIGEON_HEADER_10_FILE=" + secret,
+		"SMTP_PIGEON_HEADER=A: 1",
+		"SMTP_PIGEON_TEMPLATE_FILE=body.tmpl",
+		"SMTP_PIGEON_SIGN_SECRET_FILE=" + secret,
+	}, knownOptions)
+	assert.Nil(err)
+	assert.Equal([]config.Option{
+		{Name: "header", Values: []string{"A: 1", "B: 2", "s3cret"}, Source: "SMTP_PIGEON_HEADER, SMTP_PIGEON_HEADER_2, SMTP_PIGEON_HEADER_10_FILE"},
+		// options ending in -file are the option itself, not read from a file
+		{Name: "sign-secret-file", Values: []string{secret}, Source: "SMTP_PIGEON_SIGN_SECRET_FILE"},
+		{Name: "template-file", Values: []string{"body.tmpl"}, Source: "SMTP_PIGEON_TEMPLATE_FILE"},
+		{Name: "url", Values: []string{"https://example.com"}, Source: "SMTP_PIGEON_URL"},
+	}, options)
+	// typos and variables meant for something else are left to the caller
+	assert.Equal([]string{"SMTP_PIGEON_HEADER_0", "SMTP_PIGEON_TIMEOUT_1", "SMTP_PIGEON_TIMEUOT"}, unknown)
+}
+
+func TestEnvOptionsErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		environ []string
+		err     string
+	}{
+		{[]string{"SMTP_PIGEON_URL_FILE=/does/not/exist"}, "SMTP_PIGEON_URL_FILE: open /does/not/exist"},
+		{[]string{"SMTP_PIGEON_URL=a", "SMTP_PIGEON_URL_FILE=/tmp"}, "SMTP_PIGEON_URL_FILE: read /tmp"},
+		{[]string{"SMTP_PIGEON_HEADER_1=A: 1", "SMTP_PIGEON_HEADER_1=A: 2"}, "SMTP_PIGEON_HEADER_1 and SMTP_PIGEON_HEADER_1: both set the same option"},
+	}
+	for _, c := range cases {
+		_, _, err := config.EnvOptions(c.environ, knownOptions)
+		if assert.NotNil(err, c.environ) {
+			assert.Contains(err.Error(), c.err)
+		}
+	}
+}
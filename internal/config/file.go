@@ -0,0 +1,613 @@
+package config
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"math"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// File is a parsed configuration file. Options are named after the command
+// line flags, without the leading "--", endpoints accept any of the endpoint
+// flags, routes pick which endpoints a message goes to and rules act on
+// messages before they are routed.
+type File struct {
+	Path      string
+	Options   []Option
+	Endpoints []FileEndpoint
+	Routes    []FileRoute
+	Rules     []FileRule
+}
+
+// Option is one flag value from a file or the environment, repeated flags may
+// have several.
+type Option struct {
+	Name   string
+	Values []string
+	Line   int
+	// Source is where the option came from, for errors
+	Source string
+}
+
+// Errorf returns an error pointing at where the option came from
+func (opt Option) Errorf(format string, args ...any) error {
+	return fmt.Errorf("%s: %s", opt.Source, fmt.Sprintf(format, args...))
+}
+
+// FileEndpoint is a named endpoint and its options
+type FileEndpoint struct {
+	Name    string
+	Options []Option
+	Line    int
+}
+
+// FileRoute is an unparsed Route, Endpoints holds endpoint names
+type FileRoute struct {
+	Name         string
+	Sender       string
+	Recipient    string
+	Subject      string
+	Endpoints    []string
+	Template     string
+	TemplateFile string
+	TemplateName string
+	Continue     bool
+	// BatchWindow and BatchMax batch the route's messages, see BatchOptions
+	BatchWindow       time.Duration
+	BatchMax          int
+	BatchTemplate     string
+	BatchTemplateFile string
+	// size limits, see LimitOptions
+	MaxBodyChars         int
+	TruncationMarker     *string
+	DropAttachmentsAbove int
+	RejectAbove          int
+	Line                 int
+	// lines of each option, for errors
+	lines map[string]int
+}
+
+// lineOf returns the line an option was given on, or the route's line
+func (fr *FileRoute) lineOf(option string) int {
+	if line, ok := fr.lines[option]; ok {
+		return line
+	}
+	return fr.Line
+}
+
+// FileRule is an unparsed Rule, Route holds a route name
+type FileRule struct {
+	Name      string
+	Sender    string
+	Recipient string
+	Subject   string
+	Body      string
+	Headers   map[string]string
+	MinSize   int
+	MaxSize   int
+	Action    string
+	Route     string
+	Set       map[string]string
+	Message   string
+	Line      int
+	// lines of each option, for errors
+	lines map[string]int
+}
+
+// lineOf returns the line an option was given on, or the rule's line
+func (fr *FileRule) lineOf(option string) int {
+	if line, ok := fr.lines[option]; ok {
+		return line
+	}
+	return fr.Line
+}
+
+// pathOptions are resolved relative to the file's directory
+var pathOptions = map[string]bool{
+	"template-file":            true,
+	"tls-ca":                   true,
+	"tls-cert":                 true,
+	"tls-key":                  true,
+	"sign-secret-file":         true,
+	"oauth-client-secret-file": true,
+	"spool-dir":                true,
+	"template-dir":             true,
+	"secrets-dir":              true,
+}
+
+// LoadFile reads a YAML (.yaml or .yml) or TOML (.toml) configuration file.
+func LoadFile(path string) (*File, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read config file: %v", err)
+	}
+	var doc *yaml.Node
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		doc, err = parseYAML(b)
+	case ".toml":
+		doc, err = parseTOML(b)
+	default:
+		return nil, fmt.Errorf("Config file must end in .yaml, .yml or .toml, got %q", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	f := &File{Path: path}
+	if err := f.decode(doc); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Errorf returns an error pointing at a line of the file
+func (f *File) Errorf(line int, format string, args ...any) error {
+	return fmt.Errorf("%s:%d: %s", f.Path, line, fmt.Sprintf(format, args...))
+}
+
+// Resolve makes a relative path in the file relative to the file's directory
+func (f *File) Resolve(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(f.Path), path)
+}
+
+// BuildRoutes parses the file's routes, endpoint names are looked up in
+// endpoints and templates are limited by access.
+func (f *File) BuildRoutes(endpoints map[string]*Endpoint, access *TemplateAccess) ([]*Route, error) {
+	var routes []*Route
+	seen := map[string]bool{}
+	for _, fr := range f.Routes {
+		route := &Route{Name: fr.Name, Continue: fr.Continue}
+		for _, p := range []struct {
+			re      **regexp.Regexp
+			name    string
+			pattern string
+		}{
+			{&route.Sender, "sender", fr.Sender},
+			{&route.Recipient, "recipient", fr.Recipient},
+			{&route.Subject, "subject", fr.Subject},
+		} {
+			if p.pattern == "" {
+				continue
+			}
+			re, err := regexp.Compile(p.pattern)
+			if err != nil {
+				return nil, f.Errorf(fr.lineOf(p.name), "route %q: could not parse %v pattern: %v", fr.Name, p.name, err)
+			}
+			*p.re = re
+		}
+		if len(fr.Endpoints) == 0 {
+			return nil, f.Errorf(fr.Line, "route %q has no endpoints", fr.Name)
+		}
+		for _, name := range fr.Endpoints {
+			endpoint, ok := endpoints[name]
+			if !ok {
+				return nil, f.Errorf(fr.lineOf("endpoints"), "route %q: unknown endpoint %q", fr.Name, name)
+			}
+			route.Endpoints = append(route.Endpoints, endpoint)
+		}
+		if fr.TemplateName != "" {
+			if fr.Template != "" || fr.TemplateFile != "" {
+				return nil, f.Errorf(fr.lineOf("template-name"), "route %q: template-name cannot be used with template or template-file", fr.Name)
+			}
+			tmpl, err := NamedTemplate(fr.TemplateName, access)
+			if err != nil {
+				return nil, f.Errorf(fr.lineOf("template-name"), "route %q: %v", fr.Name, err)
+			}
+			route.Template = tmpl
+		}
+		tmpl, err := f.routeTemplate(&fr, fr.Name, "template", fr.Template, fr.TemplateFile, access)
+		if err != nil {
+			return nil, err
+		}
+		if tmpl != nil {
+			route.Template = tmpl
+		}
+		if fr.BatchWindow != 0 || fr.BatchMax != 0 || fr.BatchTemplate != "" || fr.BatchTemplateFile != "" {
+			route.Batch, err = f.routeBatch(&fr, access)
+			if err != nil {
+				return nil, err
+			}
+			if route.Template != nil {
+				return nil, f.Errorf(fr.lineOf("batch-window"), "route %q: batches are rendered by batch-template, not template", fr.Name)
+			}
+		}
+		if fr.MaxBodyChars != 0 || fr.TruncationMarker != nil || fr.DropAttachmentsAbove != 0 || fr.RejectAbove != 0 {
+			route.Limits = &LimitOptions{
+				MaxBodyChars:         fr.MaxBodyChars,
+				TruncationMarker:     DefaultTruncationMarker,
+				DropAttachmentsAbove: fr.DropAttachmentsAbove,
+				RejectAbove:          fr.RejectAbove,
+			}
+			if fr.TruncationMarker != nil {
+				route.Limits.TruncationMarker = *fr.TruncationMarker
+			}
+			if err := route.Limits.Validate(); err != nil {
+				return nil, f.Errorf(fr.Line, "route %q: %v", fr.Name, err)
+			}
+		}
+		if seen[route.Name] {
+			return nil, f.Errorf(fr.Line, "route %q is defined more than once", fr.Name)
+		}
+		seen[route.Name] = true
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// routeTemplate parses a route's template from the option or, if given, the
+// option's -file variant. It is nil when neither is set.
+func (f *File) routeTemplate(fr *FileRoute, name string, option string, text string, file string, access *TemplateAccess) (*template.Template, error) {
+	line := fr.lineOf(option)
+	if file != "" {
+		line = fr.lineOf(option + "-file")
+		b, err := os.ReadFile(f.Resolve(file))
+		if err != nil {
+			return nil, f.Errorf(line, "route %q: could not read %v file: %v", fr.Name, option, err)
+		}
+		text = string(b)
+	}
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := ParseTemplate(name, text, access)
+	if err != nil {
+		return nil, f.Errorf(line, "route %q: %v", fr.Name, err)
+	}
+	return tmpl, nil
+}
+
+// routeBatch builds a route's batch options
+func (f *File) routeBatch(fr *FileRoute, access *TemplateAccess) (*BatchOptions, error) {
+	batch := &BatchOptions{Window: fr.BatchWindow, Max: fr.BatchMax}
+	if err := batch.Validate(); err != nil {
+		return nil, f.Errorf(fr.lineOf("batch-window"), "route %q: %v", fr.Name, err)
+	}
+	tmpl, err := f.routeTemplate(fr, fr.Name+"-batch", "batch-template", fr.BatchTemplate, fr.BatchTemplateFile, access)
+	if err != nil {
+		return nil, err
+	}
+	if tmpl == nil {
+		tmpl, err = ParseTemplate(fr.Name+"-batch", DefaultBatchTemplateString(), access)
+		if err != nil {
+			return nil, err
+		}
+	}
+	batch.Template = tmpl
+	return batch, nil
+}
+
+// BuildRules parses the file's rules, route names are looked up in routes
+func (f *File) BuildRules(routes []*Route) ([]*Rule, error) {
+	var rules []*Rule
+	for _, fr := range f.Rules {
+		rule := &Rule{
+			Name:    fr.Name,
+			MinSize: fr.MinSize,
+			MaxSize: fr.MaxSize,
+			Action:  fr.Action,
+			Vars:    fr.Set,
+			Message: fr.Message,
+		}
+		for _, p := range []struct {
+			re      **regexp.Regexp
+			name    string
+			pattern string
+		}{
+			{&rule.Sender, "sender", fr.Sender},
+			{&rule.Recipient, "recipient", fr.Recipient},
+			{&rule.Subject, "subject", fr.Subject},
+			{&rule.Body, "body", fr.Body},
+		} {
+			if p.pattern == "" {
+				continue
+			}
+			re, err := regexp.Compile(p.pattern)
+			if err != nil {
+				return nil, f.Errorf(fr.lineOf(p.name), "rule %q: could not parse %v pattern: %v", fr.Name, p.name, err)
+			}
+			*p.re = re
+		}
+		for name, pattern := range fr.Headers {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, f.Errorf(fr.lineOf("header"), "rule %q: could not parse header %q pattern: %v", fr.Name, name, err)
+			}
+			if rule.Headers == nil {
+				rule.Headers = map[string]*regexp.Regexp{}
+			}
+			rule.Headers[textproto.CanonicalMIMEHeaderKey(name)] = re
+		}
+		if fr.MinSize < 0 || fr.MaxSize < 0 {
+			return nil, f.Errorf(fr.Line, "rule %q: sizes must not be negative", fr.Name)
+		}
+
+		if rule.Action == "" && len(rule.Vars) > 0 {
+			rule.Action = RuleSet
+		}
+		switch rule.Action {
+		case RuleDrop, RuleReject, RuleSet:
+		case RuleRouteTo:
+			for _, route := range routes {
+				if route.Name == fr.Route {
+					rule.Route = route
+				}
+			}
+			if rule.Route == nil {
+				return nil, f.Errorf(fr.lineOf("route"), "rule %q: unknown route %q", fr.Name, fr.Route)
+			}
+		case "":
+			return nil, f.Errorf(fr.Line, "rule %q has no action", fr.Name)
+		default:
+			return nil, f.Errorf(fr.lineOf("action"), "rule %q: action must be drop, reject, route-to or set, got %q", fr.Name, rule.Action)
+		}
+		if fr.Route != "" && rule.Action != RuleRouteTo {
+			return nil, f.Errorf(fr.lineOf("route"), "rule %q: route is only used by route-to", fr.Name)
+		}
+		if fr.Message != "" && rule.Action != RuleReject {
+			return nil, f.Errorf(fr.lineOf("message"), "rule %q: message is only used by reject", fr.Name)
+		}
+		if rule.Message == "" {
+			rule.Message = "Message rejected"
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseYAML(b []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		// empty file
+		return &yaml.Node{Kind: yaml.MappingNode, Line: 1}, nil
+	}
+	return doc.Content[0], nil
+}
+
+func (f *File) decode(doc *yaml.Node) error {
+	if doc.Kind != yaml.MappingNode {
+		return f.Errorf(doc.Line, "expected a mapping of options")
+	}
+	for i := 0; i < len(doc.Content); i += 2 {
+		key, value := doc.Content[i], doc.Content[i+1]
+		var err error
+		switch key.Value {
+		case "endpoints":
+			err = f.decodeEndpoints(value)
+		case "routes":
+			err = f.decodeRoutes(value)
+		case "rules":
+			err = f.decodeRules(value)
+		default:
+			var opt Option
+			opt, err = f.decodeOption(key, value)
+			f.Options = append(f.Options, opt)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeOption reads a scalar or list of scalars
+func (f *File) decodeOption(key *yaml.Node, value *yaml.Node) (Option, error) {
+	opt := Option{Name: key.Value, Line: key.Line, Source: fmt.Sprintf("%s:%d", f.Path, key.Line)}
+	switch value.Kind {
+	case yaml.ScalarNode:
+		opt.Values = []string{scalarValue(value)}
+	case yaml.SequenceNode:
+		for _, item := range value.Content {
+			if item.Kind != yaml.ScalarNode {
+				return opt, f.Errorf(item.Line, "%v: expected a list of values", key.Value)
+			}
+			opt.Values = append(opt.Values, scalarValue(item))
+		}
+	default:
+		return opt, f.Errorf(value.Line, "%v: expected a value or list of values", key.Value)
+	}
+	if pathOptions[opt.Name] {
+		for i, v := range opt.Values {
+			opt.Values[i] = f.Resolve(v)
+		}
+	}
+	return opt, nil
+}
+
+// scalarValue is a scalar as it would be given on the command line, YAML's
+// .inf and .nan are spelled the way flags parse them
+func scalarValue(node *yaml.Node) string {
+	if node.ShortTag() == "!!float" {
+		var f float64
+		if node.Decode(&f) == nil && (math.IsInf(f, 0) || math.IsNaN(f)) {
+			return strconv.FormatFloat(f, 'g', -1, 64)
+		}
+	}
+	return node.Value
+}
+
+func (f *File) decodeEndpoints(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return f.Errorf(node.Line, "endpoints: expected a mapping of endpoint names to options")
+	}
+	for i := 0; i < len(node.Content); i += 2 {
+		name, options := node.Content[i], node.Content[i+1]
+		if options.Kind != yaml.MappingNode {
+			return f.Errorf(options.Line, "endpoint %q: expected a mapping of options", name.Value)
+		}
+		if name.Value == DefaultEndpoint {
+			return f.Errorf(name.Line, "endpoint %q: the name is reserved for the top level endpoint", name.Value)
+		} else if strings.HasPrefix(name.Value, DryRunPrefix) {
+			return f.Errorf(name.Line, "endpoint %q: names starting with %q are reserved for the dry run", name.Value, DryRunPrefix)
+		}
+		endpoint := FileEndpoint{Name: name.Value, Line: name.Line}
+		for j := 0; j < len(options.Content); j += 2 {
+			opt, err := f.decodeOption(options.Content[j], options.Content[j+1])
+			if err != nil {
+				return err
+			}
+			endpoint.Options = append(endpoint.Options, opt)
+		}
+		f.Endpoints = append(f.Endpoints, endpoint)
+	}
+	return nil
+}
+
+func (f *File) decodeRoutes(node *yaml.Node) error {
+	if node.Kind != yaml.SequenceNode {
+		return f.Errorf(node.Line, "routes: expected a list of routes")
+	}
+	for i, item := range node.Content {
+		if item.Kind != yaml.MappingNode {
+			return f.Errorf(item.Line, "routes: expected each route to be a mapping")
+		}
+		route := FileRoute{Name: strconv.Itoa(i + 1), Line: item.Line, lines: map[string]int{}}
+		for j := 0; j < len(item.Content); j += 2 {
+			key, value := item.Content[j], item.Content[j+1]
+			route.lines[key.Value] = key.Line
+			var err error
+			switch key.Value {
+			case "name":
+				err = value.Decode(&route.Name)
+			case "sender":
+				err = value.Decode(&route.Sender)
+			case "recipient":
+				err = value.Decode(&route.Recipient)
+			case "subject":
+				err = value.Decode(&route.Subject)
+			case "template":
+				err = value.Decode(&route.Template)
+			case "template-file":
+				err = value.Decode(&route.TemplateFile)
+			case "template-name":
+				err = value.Decode(&route.TemplateName)
+			case "continue":
+				err = value.Decode(&route.Continue)
+			case "batch-window":
+				err = value.Decode(&route.BatchWindow)
+			case "batch-max":
+				err = value.Decode(&route.BatchMax)
+			case "batch-template":
+				err = value.Decode(&route.BatchTemplate)
+			case "batch-template-file":
+				err = value.Decode(&route.BatchTemplateFile)
+			case "max-body-chars":
+				err = value.Decode(&route.MaxBodyChars)
+			case "truncation-marker":
+				err = value.Decode(&route.TruncationMarker)
+			case "drop-attachments-above":
+				err = value.Decode(&route.DropAttachmentsAbove)
+			case "reject-above":
+				err = value.Decode(&route.RejectAbove)
+			case "endpoints":
+				if value.Kind == yaml.ScalarNode {
+					route.Endpoints = []string{value.Value}
+				} else {
+					err = value.Decode(&route.Endpoints)
+				}
+			default:
+				return f.Errorf(key.Line, "route %q: unknown option %q", route.Name, key.Value)
+			}
+			if err != nil {
+				return f.Errorf(value.Line, "route %q: %v: %v", route.Name, key.Value, yamlErrorMessage(err))
+			}
+		}
+		f.Routes = append(f.Routes, route)
+	}
+	return nil
+}
+
+func (f *File) decodeRules(node *yaml.Node) error {
+	if node.Kind != yaml.SequenceNode {
+		return f.Errorf(node.Line, "rules: expected a list of rules")
+	}
+	for i, item := range node.Content {
+		if item.Kind != yaml.MappingNode {
+			return f.Errorf(item.Line, "rules: expected each rule to be a mapping")
+		}
+		rule := FileRule{Name: strconv.Itoa(i + 1), Line: item.Line, lines: map[string]int{}}
+		for j := 0; j < len(item.Content); j += 2 {
+			key, value := item.Content[j], item.Content[j+1]
+			rule.lines[key.Value] = key.Line
+			var err error
+			switch key.Value {
+			case "name":
+				err = value.Decode(&rule.Name)
+			case "sender":
+				err = value.Decode(&rule.Sender)
+			case "recipient":
+				err = value.Decode(&rule.Recipient)
+			case "subject":
+				err = value.Decode(&rule.Subject)
+			case "body":
+				err = value.Decode(&rule.Body)
+			case "header":
+				err = value.Decode(&rule.Headers)
+			case "min-size":
+				err = value.Decode(&rule.MinSize)
+			case "max-size":
+				err = value.Decode(&rule.MaxSize)
+			case "action":
+				err = value.Decode(&rule.Action)
+			case "route":
+				err = value.Decode(&rule.Route)
+			case "set":
+				err = value.Decode(&rule.Set)
+			case "message":
+				err = value.Decode(&rule.Message)
+			default:
+				return f.Errorf(key.Line, "rule %q: unknown option %q", rule.Name, key.Value)
+			}
+			if err != nil {
+				return f.Errorf(value.Line, "rule %q: %v: %v", rule.Name, key.Value, yamlErrorMessage(err))
+			}
+		}
+		f.Rules = append(f.Rules, rule)
+	}
+	return nil
+}
+
+// yamlErrorMessage drops the "yaml: unmarshal errors" preamble and line
+// numbers, which the caller already reports.
+func yamlErrorMessage(err error) string {
+	if typeErr, ok := err.(*yaml.TypeError); ok && len(typeErr.Errors) > 0 {
+		msg := typeErr.Errors[0]
+		if _, rest, ok := strings.Cut(msg, ": "); ok && strings.HasPrefix(msg, "line ") {
+			return rest
+		}
+		return msg
+	}
+	return err.Error()
+}
+
+// TemplateFiles returns the template files the endpoints and routes read
+func (f *File) TemplateFiles() []string {
+	var paths []string
+	for _, endpoint := range f.Endpoints {
+		for _, opt := range endpoint.Options {
+			if opt.Name == "template-file" {
+				paths = append(paths, opt.Values...)
+			}
+		}
+	}
+	for _, route := range f.Routes {
+		for _, path := range []string{route.TemplateFile, route.BatchTemplateFile} {
+			if path != "" {
+				paths = append(paths, f.Resolve(path))
+			}
+		}
+	}
+	return paths
+}
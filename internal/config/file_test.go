@@ -0,0 +1,296 @@
+package config_test
+
+import (
+	"fmt"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const yamlFile = `port: 2525
+header:
+  - "Content-Type: application/json"
+  - "X-Node: one"
+tls-ca: ca.pem
+
+endpoints:
+  slack:
+    url: https://hooks.slack.com/services/x
+    timeout: 5s
+  ops:
+    url: syslog+udp://localhost
+
+routes:
+  - name: alerts
+    recipient: ^alerts@
+    endpoints: [slack, ops]
+    template: "{{.ID}}"
+  - endpoints: ops
+    continue: true
+`
+
+const tomlFile = `port = 2525
+header = ["Content-Type: application/json", "X-Node: one"]
+tls-ca = "ca.pem"
+
+[endpoints.slack]
+url = "https://hooks.slack.com/services/x"
+timeout = "5s"
+
+[endpoints.ops]
+url = "syslog+udp://localhost"
+
+[[routes]]
+name = "alerts"
+recipient = "^alerts@"
+endpoints = ["slack", "ops"]
+template = "{{.ID}}"
+
+[[routes]]
+endpoints = ["ops"]
+continue = true
+`
+
+func TestLoadFile(t *testing.T) {
+	for name, content := range map[string]string{"pigeon.yaml": yamlFile, "pigeon.toml": tomlFile} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			path := writeFile(t, name, content)
+			file, err := config.LoadFile(path)
+			assert.Nil(err)
+
+			tlsLine := map[string]int{"pigeon.yaml": 5, "pigeon.toml": 3}[name]
+			assert.Equal([]config.Option{
+				{Name: "port", Values: []string{"2525"}, Line: 1, Source: path + ":1"},
+				{Name: "header", Values: []string{"Content-Type: application/json", "X-Node: one"}, Line: 2, Source: path + ":2"},
+				{Name: "tls-ca", Values: []string{filepath.Join(filepath.Dir(path), "ca.pem")}, Line: tlsLine, Source: fmt.Sprintf("%v:%d", path, tlsLine)},
+			}, file.Options)
+
+			assert.Equal(2, len(file.Endpoints))
+			assert.Equal("slack", file.Endpoints[0].Name)
+			assert.Equal("url", file.Endpoints[0].Options[0].Name)
+			assert.Equal([]string{"5s"}, file.Endpoints[0].Options[1].Values)
+
+			assert.Equal(2, len(file.Routes))
+			assert.Equal("alerts", file.Routes[0].Name)
+			assert.Equal("^alerts@", file.Routes[0].Recipient)
+			assert.Equal([]string{"slack", "ops"}, file.Routes[0].Endpoints)
+			assert.Equal("{{.ID}}", file.Routes[0].Template)
+			assert.Equal("2", file.Routes[1].Name)
+			assert.Equal([]string{"ops"}, file.Routes[1].Endpoints)
+			assert.True(file.Routes[1].Continue)
+		})
+	}
+}
+
+func TestLoadFileFloats(t *testing.T) {
+	assert := assert.New(t)
+
+	// TOML's inf and nan are YAML's .inf and .nan, both read like flags
+	for name, content := range map[string]string{
+		"pigeon.yaml": "rate-limit: .inf\nrate-burst: -.inf\nrate-queue: .nan\n",
+		"pigeon.toml": "rate-limit = inf\nrate-burst = -inf\nrate-queue = nan\n",
+	} {
+		file, err := config.LoadFile(writeFile(t, name, content))
+		if assert.Nil(err, name) {
+			assert.Equal([]string{"+Inf"}, file.Options[0].Values, name)
+			assert.Equal([]string{"-Inf"}, file.Options[1].Values, name)
+			assert.Equal([]string{"NaN"}, file.Options[2].Values, name)
+		}
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"bad.yaml", "port: 1\nheader:\n  - a: b\n", ":3: header: expected a list of values"},
+		{"bad.yaml", "routes:\n  - name: a\n    continue: maybe\n", ":3: route \"a\": continue: cannot unmarshal !!str `maybe` into bool"},
+		{"bad.yaml", "routes:\n  - name: a\n    colour: red\n", ":3: route \"a\": unknown option \"colour\""},
+		{"bad.yaml", "url: x\n  port: 1\n", "line 2"},
+		{"bad.toml", "port = 1\nport = 2\n", "line 2: \"port\" is defined more than once"},
+		{"bad.toml", "[[routes]]\nname = \"a\"\ncontinue = \"maybe\"\n", ":3: route \"a\": continue: cannot unmarshal !!str `maybe` into bool"},
+		{"bad.toml", "port = [1\n", "line 2"},
+		{"bad.toml", "[endpoints.a]\nurl = \"x\"\n\n[endpoints.a]\ntimeout = \"5s\"\n", "line 4: \"a\" is defined more than once"},
+		{"bad.toml", "endpoints.a.url = \"x\"\n[endpoints.a]\n", "line 2: \"a\" is defined more than once"},
+		{"bad.toml", "endpoints = { a = { url = \"x\" } }\n[endpoints.b]\n", "line 2: \"endpoints\" is defined more than once"},
+		{"bad.yaml", "endpoints:\n  default:\n    url: x\n", ":2: endpoint \"default\": the name is reserved"},
+		{"bad.toml", "[endpoints.dryrun-slack]\nurl = \"x\"\n", ":1: endpoint \"dryrun-slack\": names starting with \"dryrun-\" are reserved"},
+		{"bad.ini", "port = 1\n", "must end in .yaml, .yml or .toml"},
+	}
+	for _, c := range cases {
+		_, err := config.LoadFile(writeFile(t, c.name, c.content))
+		if assert.NotNil(err, c.content) {
+			assert.Contains(err.Error(), c.err)
+		}
+	}
+}
+
+func TestBuildRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "route.tmpl"), []byte("{{.Sender}}"), 0600)
+	path := filepath.Join(dir, "pigeon.yaml")
+	os.WriteFile(path, []byte(`routes:
+  - name: from-file
+    sender: ^ops@
+    endpoints: [a]
+    template-file: route.tmpl
+  - name: unknown
+    endpoints:
+      - a
+      - b
+`), 0600)
+	file, err := config.LoadFile(path)
+	assert.Nil(err)
+
+	a := &config.Endpoint{Name: "a"}
+	_, err = file.BuildRoutes(map[string]*config.Endpoint{"a": a}, nil)
+	assert.EqualError(err, path+`:7: route "unknown": unknown endpoint "b"`)
+
+	routes, err := file.BuildRoutes(map[string]*config.Endpoint{"a": a, "b": a}, nil)
+	assert.Nil(err)
+	assert.Equal(2, len(routes))
+	assert.Equal([]*config.Endpoint{a}, routes[0].Endpoints)
+	assert.True(routes[0].Matches("ops@host", nil, ""))
+	assert.False(routes[0].Matches("dev@host", nil, ""))
+	assert.Nil(routes[1].Template)
+}
+
+func TestBuildRoutesBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	endpoints := map[string]*config.Endpoint{"a": {Name: "a"}}
+	file, err := config.LoadFile(writeFile(t, "pigeon.yaml", `routes:
+  - name: digest
+    endpoints: a
+    batch-window: 5m
+    batch-max: 20
+  - name: cron
+    endpoints: a
+    batch-window: 1h
+    batch-template: "{{len .Messages}}"
+`))
+	assert.Nil(err)
+	routes, err := file.BuildRoutes(endpoints, nil)
+	if assert.Nil(err) {
+		assert.Equal(5*time.Minute, routes[0].Batch.Window)
+		assert.Equal(20, routes[0].Batch.Max)
+		assert.Equal(time.Hour, routes[1].Batch.Window)
+		assert.Equal("cron-batch", routes[1].Batch.Template.Name())
+		assert.Equal(routes[1].Batch, routes[1].Targets()[0].Batch)
+	}
+
+	cases := []struct {
+		content string
+		err     string
+	}{
+		{"routes:\n  - endpoints: a\n    batch-max: 5\n", `:2: route "1": Batch window must be positive`},
+		{"routes:\n  - endpoints: a\n    batch-window: 1m\n    template: x\n", `:3: route "1": batches are rendered by batch-template, not template`},
+		{"routes:\n  - name: a\n    endpoints: a\n  - name: a\n    endpoints: a\n", `:4: route "a" is defined more than once`},
+	}
+	for _, c := range cases {
+		file, err := config.LoadFile(writeFile(t, "pigeon.yaml", c.content))
+		if assert.Nil(err) {
+			_, err = file.BuildRoutes(endpoints, nil)
+			if assert.NotNil(err, c.content) {
+				assert.Contains(err.Error(), c.err)
+			}
+		}
+	}
+}
+
+func TestBuildRoutesLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	endpoints := map[string]*config.Endpoint{"a": {Name: "a"}}
+	file, err := config.LoadFile(writeFile(t, "pigeon.yaml", `routes:
+  - name: chat
+    endpoints: a
+    max-body-chars: 3000
+    drop-attachments-above: 100000
+    reject-above: 500000
+    continue: true
+  - name: quiet
+    endpoints: a
+    max-body-chars: 10
+    truncation-marker: ""
+  - name: archive
+    endpoints: a
+`))
+	assert.Nil(err)
+	routes, err := file.BuildRoutes(endpoints, nil)
+	if assert.Nil(err) {
+		assert.Equal(&config.LimitOptions{
+			MaxBodyChars:         3000,
+			TruncationMarker:     config.DefaultTruncationMarker,
+			DropAttachmentsAbove: 100000,
+			RejectAbove:          500000,
+		}, routes[0].Limits)
+		assert.Equal(routes[0].Limits, routes[0].Targets()[0].Limits)
+		assert.Equal("0123456789", routes[1].Limits.Truncate("0123456789abc"))
+		assert.Nil(routes[2].Limits)
+		assert.False(routes[2].Limits.Rejects(1 << 30))
+	}
+
+	file, _ = config.LoadFile(writeFile(t, "pigeon.yaml", "routes:\n  - endpoints: a\n    reject-above: -1\n"))
+	_, err = file.BuildRoutes(endpoints, nil)
+	assert.ErrorContains(err, `:2: route "1": Size limits must not be negative`)
+}
+
+func TestTargets(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, _ := config.NewConfig("http://localhost", []string{}, "{{.ID}}", false)
+	targets := cfg.Targets("a@host", []string{"b@host"}, "hi")
+	assert.Equal(1, len(targets))
+	assert.Equal(&cfg.Endpoint, targets[0].Endpoint)
+
+	alerts, _ := config.NewEndpoint("alerts", "http://alerts", nil, "alert", nil)
+	all, _ := config.NewEndpoint("all", "http://all", nil, "all", nil)
+	routeTemplate, _ := config.ParseTemplate("route", "route", nil)
+	cfg.Routes = []*config.Route{
+		{
+			Name:      "alerts",
+			Recipient: regexp.MustCompile("^alerts@"),
+			Endpoints: []*config.Endpoint{alerts},
+			Template:  routeTemplate,
+			Continue:  true,
+		},
+		{Name: "subject", Subject: regexp.MustCompile("urgent"), Endpoints: []*config.Endpoint{alerts}},
+		{Name: "all", Endpoints: []*config.Endpoint{all}},
+	}
+
+	targets = cfg.Targets("a@host", []string{"b@host", "alerts@host"}, "hi")
+	assert.Equal(2, len(targets))
+	assert.Equal("alerts", targets[0].Route)
+	assert.Equal(routeTemplate, targets[0].Template)
+	assert.Equal("all", targets[1].Route)
+	assert.Equal(all.Template, targets[1].Template)
+
+	// first match wins without continue
+	targets = cfg.Targets("a@host", []string{"b@host"}, "urgent")
+	assert.Equal(1, len(targets))
+	assert.Equal("subject", targets[0].Route)
+
+	cfg.Routes = cfg.Routes[:1]
+	assert.Empty(cfg.Targets("a@host", []string{"b@host"}, "hi"))
+}
@@ -0,0 +1,332 @@
+package config
+
+import (
+	"fmt"
+	"golang.org/x/net/html"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// textFuncs returns the functions for turning mail into chat messages
+func textFuncs() template.FuncMap {
+	return template.FuncMap{
+		"htmlToText":     HTMLToText,
+		"htmlToMarkdown": HTMLToMarkdown,
+		"slackEscape":    SlackEscape,
+		"telegramEscape": TelegramEscape,
+		"discordEscape":  DiscordEscape,
+		"truncate":       Truncate,
+	}
+}
+
+// HTMLToText converts HTML to plain text. Links are followed by their URL in
+// brackets, list items start with "- " or their number and table cells are
+// separated by " | ".
+func HTMLToText(s string) string {
+	return convertHTML(s, false)
+}
+
+// HTMLToMarkdown converts HTML to Markdown, with GitHub style tables. Text is
+// not escaped, so Markdown in the HTML's text is kept.
+func HTMLToMarkdown(s string) string {
+	return convertHTML(s, true)
+}
+
+func convertHTML(s string, markdown bool) string {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		// the parser accepts anything a browser would, this is a read error
+		return s
+	}
+	c := &htmlConverter{markdown: markdown}
+	return tidyLines(c.children(doc))
+}
+
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+// tidyLines drops trailing spaces and runs of blank lines
+func tidyLines(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	s = strings.Join(lines, "\n")
+	return strings.Trim(blankLines.ReplaceAllString(s, "\n\n"), "\n")
+}
+
+type htmlConverter struct {
+	markdown bool
+	pre      int // depth of <pre>, which keeps whitespace
+}
+
+// children converts n's children, spaces at the start of a line are dropped
+// outside of <pre>
+func (c *htmlConverter) children(n *html.Node) string {
+	var b strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		s := c.node(child)
+		if c.pre == 0 && (b.Len() == 0 || strings.HasSuffix(b.String(), "\n")) {
+			s = strings.TrimLeft(s, " ")
+		}
+		b.WriteString(s)
+	}
+	return b.String()
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+func (c *htmlConverter) node(n *html.Node) string {
+	switch n.Type {
+	case html.TextNode:
+		if c.pre > 0 {
+			return n.Data
+		}
+		return whitespace.ReplaceAllString(n.Data, " ")
+	case html.ElementNode:
+		return c.element(n)
+	case html.DocumentNode:
+		return c.children(n)
+	}
+	return ""
+}
+
+func (c *htmlConverter) element(n *html.Node) string {
+	switch n.Data {
+	case "head", "script", "style", "title", "noscript", "template":
+		return ""
+	case "br":
+		return "\n"
+	case "hr":
+		return block("---")
+	case "p", "div", "section", "article", "header", "footer", "main", "nav", "aside", "address", "figure", "center":
+		return block(c.children(n))
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		text := oneLine(c.children(n))
+		if c.markdown {
+			level, _ := strconv.Atoi(n.Data[1:])
+			text = strings.Repeat("#", level) + " " + text
+		}
+		return block(text)
+	case "a":
+		text := c.children(n)
+		href := attr(n, "href")
+		switch {
+		case href == "" || strings.HasPrefix(href, "#"):
+			return text
+		case c.markdown:
+			if strings.TrimSpace(text) == "" {
+				text = href
+			}
+			return fmt.Sprintf("[%s](%s)", text, href)
+		case strings.TrimSpace(text) == "" || text == href || "mailto:"+text == href:
+			return strings.TrimPrefix(href, "mailto:")
+		}
+		return fmt.Sprintf("%s (%s)", text, href)
+	case "img":
+		alt := attr(n, "alt")
+		if c.markdown && attr(n, "src") != "" {
+			return fmt.Sprintf("![%s](%s)", alt, attr(n, "src"))
+		}
+		return alt
+	case "strong", "b":
+		return c.wrap(n, "**")
+	case "em", "i":
+		return c.wrap(n, "_")
+	case "code":
+		if c.pre > 0 {
+			return c.children(n)
+		}
+		return c.wrap(n, "`")
+	case "pre":
+		c.pre++
+		text := strings.Trim(c.children(n), "\n")
+		c.pre--
+		if c.markdown {
+			text = "```\n" + text + "\n```"
+		}
+		// block would trim the first line's indent
+		return "\n\n" + text + "\n\n"
+	case "blockquote":
+		return block(prefixLines(tidyLines(c.children(n)), "> ", "> "))
+	case "ul", "ol":
+		return block(c.list(n))
+	case "table":
+		return block(c.table(n))
+	}
+	return c.children(n)
+}
+
+// wrap surrounds an inline element's text with Markdown emphasis, outside of
+// the spaces so the emphasis still applies
+func (c *htmlConverter) wrap(n *html.Node, mark string) string {
+	text := c.children(n)
+	if !c.markdown || strings.TrimSpace(text) == "" {
+		return text
+	}
+	trimmed := strings.TrimSpace(text)
+	i := strings.Index(text, trimmed)
+	return text[:i] + mark + trimmed + mark + text[i+len(trimmed):]
+}
+
+func (c *htmlConverter) list(n *html.Node) string {
+	var items []string
+	number := 1
+	if start, err := strconv.Atoi(attr(n, "start")); err == nil {
+		number = start
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != html.ElementNode || child.Data != "li" {
+			continue
+		}
+		marker := "- "
+		if n.Data == "ol" {
+			marker = strconv.Itoa(number) + ". "
+			number++
+		}
+		text := blankLines.ReplaceAllString(tidyLines(c.children(child)), "\n")
+		text = strings.ReplaceAll(text, "\n\n", "\n")
+		items = append(items, prefixLines(text, marker, strings.Repeat(" ", len(marker))))
+	}
+	return strings.Join(items, "\n")
+}
+
+func (c *htmlConverter) table(n *html.Node) string {
+	var rows [][]string
+	columns := 0
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode {
+				continue
+			}
+			switch child.Data {
+			case "tr":
+				var row []string
+				for cell := child.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.Type == html.ElementNode && (cell.Data == "td" || cell.Data == "th") {
+						text := oneLine(c.children(cell))
+						if c.markdown {
+							text = strings.ReplaceAll(text, "|", `\|`)
+						}
+						row = append(row, text)
+					}
+				}
+				if len(row) > columns {
+					columns = len(row)
+				}
+				rows = append(rows, row)
+			case "thead", "tbody", "tfoot":
+				walk(child)
+			}
+		}
+	}
+	walk(n)
+
+	var lines []string
+	for i, row := range rows {
+		if !c.markdown {
+			lines = append(lines, strings.Join(row, " | "))
+			continue
+		}
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		lines = append(lines, "| "+strings.Join(row, " | ")+" |")
+		if i == 0 {
+			lines = append(lines, "|"+strings.Repeat(" --- |", columns))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// block separates text from what's around it by a blank line
+func block(text string) string {
+	text = strings.Trim(text, " \n")
+	if text == "" {
+		return ""
+	}
+	return "\n\n" + text + "\n\n"
+}
+
+// oneLine joins text onto a single line, for headings and table cells
+func oneLine(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// prefixLines starts the first line of text with first and every other line
+// with rest
+func prefixLines(text string, first string, rest string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		prefix := rest
+		if i == 0 {
+			prefix = first
+		}
+		lines[i] = strings.TrimRight(prefix+line, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// SlackEscape escapes the characters Slack's mrkdwn treats as control
+// characters, so text can't form links or mentions
+func SlackEscape(s string) string {
+	return slackEscaper.Replace(s)
+}
+
+// telegramSpecial are the characters Telegram's MarkdownV2 requires escaping
+const telegramSpecial = "\\_*[]()~`>#+-=|{}.!"
+
+// TelegramEscape escapes text for Telegram's MarkdownV2 parse mode
+func TelegramEscape(s string) string {
+	return escapeRunes(s, telegramSpecial)
+}
+
+// discordSpecial are the characters Discord's Markdown gives a meaning to
+const discordSpecial = "\\*_~`|>#-[]()"
+
+var discordMentions = strings.NewReplacer("@everyone", "@\u200beveryone", "@here", "@\u200bhere")
+
+// DiscordEscape escapes Markdown for Discord and breaks @everyone and @here
+// mentions
+func DiscordEscape(s string) string {
+	return discordMentions.Replace(escapeRunes(s, discordSpecial))
+}
+
+func escapeRunes(s string, special string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Truncate shortens s to at most n characters, ending with "…" when
+// anything was cut. Unlike sprig's trunc it never splits a multi-byte
+// character.
+func Truncate(n int, s string) string {
+	if n < 1 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	return strings.TrimRight(string(runes[:n-1]), " ") + "…"
+}
@@ -0,0 +1,81 @@
+package config_test
+
+import (
+	"bytes"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const newsletter = `<html><head><style>p { color: red }</style></head><body>
+<h2>Backup  <b>failed</b></h2>
+<p>Job <a href="https://ci/1">nightly</a> failed on
+  <i>db1</i>.<br> See <a href="https://ci/1">https://ci/1</a></p>
+<ul><li>disk</li><li>network<ul><li>dns</li></ul></li></ul>
+<ol start="3"><li>retry</li></ol>
+<table><tr><th>Host</th><th>Status</th></tr><tr><td>db1</td><td>a|b</td></tr></table>
+<blockquote><p>quoted</p><p>twice</p></blockquote>
+<pre>  indented
+    code</pre>
+</body></html>`
+
+func TestHTMLToText(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(`Backup failed
+
+Job nightly (https://ci/1) failed on db1.
+See https://ci/1
+
+- disk
+- network
+  - dns
+
+3. retry
+
+Host | Status
+db1 | a|b
+
+> quoted
+>
+> twice
+
+  indented
+    code`, config.HTMLToText(newsletter))
+}
+
+func TestHTMLToMarkdown(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("## Backup **failed**\n\n"+
+		"Job [nightly](https://ci/1) failed on _db1_.\nSee [https://ci/1](https://ci/1)\n\n"+
+		"- disk\n- network\n  - dns\n\n"+
+		"3. retry\n\n"+
+		"| Host | Status |\n| --- | --- |\n| db1 | a\\|b |\n\n"+
+		"> quoted\n>\n> twice\n\n"+
+		"```\n  indented\n    code\n```", config.HTMLToMarkdown(newsletter))
+}
+
+func TestEscapes(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("a &lt;@U123&gt; &amp; *b*", config.SlackEscape("a <@U123> & *b*"))
+	assert.Equal(`v1\.2 \(beta\) \- \*done\*\!`, config.TelegramEscape("v1.2 (beta) - *done*!"))
+	assert.Equal("\\*\\*bold\\*\\* @\u200beveryone", config.DiscordEscape("**bold** @everyone"))
+}
+
+func TestTruncate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("short", config.Truncate(10, "short"))
+	assert.Equal("héllo…", config.Truncate(6, "héllo wörld"))
+	assert.Equal("日本…", config.Truncate(3, "日本語です"))
+	assert.Equal("", config.Truncate(0, "anything"))
+
+	tmpl, err := config.ParseTemplate("body", `{{.Body | htmlToText | truncate 8 | slackEscape}}`, nil)
+	if assert.Nil(err) {
+		var out bytes.Buffer
+		assert.Nil(tmpl.Execute(&out, map[string]string{"Body": "<p>a &amp; b &amp; c &amp; d</p>"}))
+		assert.Equal("a &amp; b &amp;…", out.String())
+	}
+}
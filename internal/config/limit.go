@@ -0,0 +1,42 @@
+package config
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// DefaultTruncationMarker ends bodies cut short by MaxBodyChars
+const DefaultTruncationMarker = "\n\n[truncated]"
+
+// LimitOptions cap the size of messages a route delivers. MaxBodyChars cuts
+// the body and text parts short, DropAttachmentsAbove removes attachments
+// larger than it in bytes and RejectAbove refuses messages larger than it in
+// bytes. Zero is no limit.
+type LimitOptions struct {
+	MaxBodyChars         int
+	TruncationMarker     string
+	DropAttachmentsAbove int
+	RejectAbove          int
+}
+
+// Validate checks the options are usable
+func (opts *LimitOptions) Validate() error {
+	if opts.MaxBodyChars < 0 || opts.DropAttachmentsAbove < 0 || opts.RejectAbove < 0 {
+		return fmt.Errorf("Size limits must not be negative")
+	}
+	return nil
+}
+
+// Rejects reports whether a message of size bytes is too big for the route
+func (opts *LimitOptions) Rejects(size int) bool {
+	return opts != nil && opts.RejectAbove > 0 && size > opts.RejectAbove
+}
+
+// Truncate cuts s to MaxBodyChars characters followed by the marker, if it is
+// any longer.
+func (opts *LimitOptions) Truncate(s string) string {
+	if opts == nil || opts.MaxBodyChars == 0 || utf8.RuneCountInString(s) <= opts.MaxBodyChars {
+		return s
+	}
+	return string([]rune(s)[:opts.MaxBodyChars]) + opts.TruncationMarker
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// OAuthOptions configures an OAuth2 client credentials grant used to
+// authenticate HTTP requests.
+type OAuthOptions struct {
+	TokenURL         string
+	ClientID         string
+	ClientSecretFile string
+	ClientSecretEnv  string
+	Scopes           []string
+	RefreshBefore    time.Duration
+}
+
+// Enabled reports whether a token URL has been configured
+func (opts *OAuthOptions) Enabled() bool {
+	return opts != nil && opts.TokenURL != ""
+}
+
+// Validate checks the options are usable
+func (opts *OAuthOptions) Validate() error {
+	if !opts.Enabled() {
+		return nil
+	}
+	tokenURL, err := url.Parse(opts.TokenURL)
+	if err != nil {
+		return fmt.Errorf("Could not parse OAuth token URL: %v", err)
+	}
+	if (tokenURL.Scheme != "http" && tokenURL.Scheme != "https") || tokenURL.Host == "" {
+		return fmt.Errorf("OAuth token URL must be an http or https URL, got %q", opts.TokenURL)
+	}
+	if opts.ClientID == "" {
+		return fmt.Errorf("OAuth client ID is required with a token URL")
+	}
+	if opts.ClientSecretFile != "" && opts.ClientSecretEnv != "" {
+		return fmt.Errorf("OAuth client secret must be given as a file or an environment variable, not both")
+	}
+	if opts.RefreshBefore < 0 {
+		return fmt.Errorf("OAuth refresh window must not be negative")
+	}
+	_, err = opts.ClientSecret()
+	return err
+}
+
+// ClientSecret reads the client secret, it is re-read each time a token is
+// requested.
+func (opts *OAuthOptions) ClientSecret() (string, error) {
+	secret, err := readSecret(opts.ClientSecretFile, opts.ClientSecretEnv)
+	if err != nil {
+		return "", fmt.Errorf("OAuth: %v", err)
+	}
+	return secret, nil
+}
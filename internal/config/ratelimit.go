@@ -0,0 +1,44 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RateLimitOptions configures the token bucket kept for each endpoint.
+// Deliveries wait for a token, up to MaxQueue may wait at once and any more
+// are handled according to Overflow: "tempfail", "spool" or "drop".
+type RateLimitOptions struct {
+	PerSecond float64
+	Burst     int
+	MaxQueue  int
+	Overflow  string
+}
+
+// Enabled reports whether a rate has been configured
+func (opts *RateLimitOptions) Enabled() bool {
+	return opts != nil && opts.PerSecond > 0
+}
+
+// Validate checks the options are usable
+func (opts *RateLimitOptions) Validate() error {
+	if opts.PerSecond < 0 {
+		return fmt.Errorf("Rate limit must not be negative, got %v", opts.PerSecond)
+	}
+	if !opts.Enabled() {
+		return nil
+	}
+	if opts.Burst < 1 {
+		return fmt.Errorf("Rate limit burst must be at least 1, got %d", opts.Burst)
+	}
+	if opts.MaxQueue < 0 {
+		return fmt.Errorf("Rate limit queue size must not be negative, got %d", opts.MaxQueue)
+	}
+	opts.Overflow = strings.ToLower(opts.Overflow)
+	switch opts.Overflow {
+	case "tempfail", "spool", "drop":
+	default:
+		return fmt.Errorf("Rate limit overflow must be tempfail, spool or drop, got %q", opts.Overflow)
+	}
+	return nil
+}
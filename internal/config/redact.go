@@ -0,0 +1,144 @@
+package config
+
+import (
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Redaction replaces text matching Pattern with Replacement, which may refer
+// to the pattern's groups like regexp.Expand. Valid, when set, must also
+// accept the match.
+type Redaction struct {
+	Name        string
+	Pattern     *regexp.Regexp
+	Replacement string
+	Valid       func(match string) bool
+}
+
+// builtinRedactions are the redactions that can be given by name alone
+var builtinRedactions = map[string][]Redaction{
+	"credit-card": {{
+		Pattern:     regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		Replacement: "[credit-card]",
+		Valid:       luhn,
+	}},
+	"bearer-token": {{
+		Pattern:     regexp.MustCompile(`(?i)\b(bearer\s+)[A-Za-z0-9\-._~+/]+=*`),
+		Replacement: "${1}[bearer-token]",
+	}},
+	"aws-key": {
+		{
+			Pattern:     regexp.MustCompile(`\b(?:AKIA|ASIA)[A-Z0-9]{16}\b`),
+			Replacement: "[aws-key]",
+		},
+		{
+			Pattern:     regexp.MustCompile(`(?i)(secret_?access_?key["']?\s*[:=]\s*["']?)[A-Za-z0-9/+]{40}\b`),
+			Replacement: "${1}[aws-key]",
+		},
+	},
+	"email": {{
+		Pattern:     regexp.MustCompile(`\b[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}\b`),
+		Replacement: "[email]",
+	}},
+}
+
+// BuiltinRedactions returns the names of the built in redactions
+func BuiltinRedactions() []string {
+	var names []string
+	for name := range builtinRedactions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RedactOptions are applied to messages before templates see them. Headers
+// are the headers redacted in .Header, every header is redacted in the raw
+// .Data as it was sent, encoded or not.
+type RedactOptions struct {
+	Redactions []Redaction
+	Headers    []string
+}
+
+// ParseRedactions converts the names of built in redactions and
+// "name=pattern" strings, replaced by "[name]", into options that redact
+// headers as well as the message.
+func ParseRedactions(args []string, headers []string) (*RedactOptions, error) {
+	opts := &RedactOptions{}
+	for _, arg := range args {
+		name, pattern, ok := strings.Cut(arg, "=")
+		if !ok {
+			builtin, ok := builtinRedactions[arg]
+			if !ok {
+				return nil, fmt.Errorf("Unknown redaction %q, must be one of %v or in the format `name=pattern`", arg, BuiltinRedactions())
+			}
+			for _, r := range builtin {
+				r.Name = arg
+				opts.Redactions = append(opts.Redactions, r)
+			}
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse redaction %q pattern: %v", name, err)
+		}
+		// the name is literal, even with a $ in it
+		replacement := "[" + strings.ReplaceAll(name, "$", "$$") + "]"
+		opts.Redactions = append(opts.Redactions, Redaction{Name: name, Pattern: re, Replacement: replacement})
+	}
+	for _, header := range headers {
+		opts.Headers = append(opts.Headers, textproto.CanonicalMIMEHeaderKey(header))
+	}
+	return opts, nil
+}
+
+// Enabled reports whether there is anything to redact
+func (opts *RedactOptions) Enabled() bool {
+	return opts != nil && len(opts.Redactions) > 0
+}
+
+// Redact applies every redaction to s, returning the result and how many
+// matches were replaced.
+func (opts *RedactOptions) Redact(s string) (string, int) {
+	if !opts.Enabled() {
+		return s, 0
+	}
+	count := 0
+	for _, r := range opts.Redactions {
+		s = r.Pattern.ReplaceAllStringFunc(s, func(match string) string {
+			if r.Valid != nil && !r.Valid(match) {
+				return match
+			}
+			count++
+			var expanded []byte
+			submatches := r.Pattern.FindStringSubmatchIndex(match)
+			return string(r.Pattern.ExpandString(expanded, r.Replacement, match, submatches))
+		})
+	}
+	return s, count
+}
+
+// luhn reports whether the digits in s pass the Luhn check, which card
+// numbers do and most other long numbers don't.
+func luhn(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n > 0 && sum%10 == 0
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"regexp"
+	"text/template"
+)
+
+// Route delivers messages matching all of its patterns to its endpoints. Nil
+// patterns match anything.
+type Route struct {
+	Name      string
+	Sender    *regexp.Regexp
+	Recipient *regexp.Regexp
+	Subject   *regexp.Regexp
+	Endpoints []*Endpoint
+	// Template overrides the endpoints' templates when set
+	Template *template.Template
+	// Continue checks later routes even when this one matches
+	Continue bool
+	// Batch collects messages to deliver together when set
+	Batch *BatchOptions
+	// Limits caps the size of messages delivered when set
+	Limits *LimitOptions
+}
+
+// Matches reports whether the message matches the route, the recipient
+// pattern must match at least one recipient.
+func (r *Route) Matches(sender string, recipients []string, subject string) bool {
+	if r.Sender != nil && !r.Sender.MatchString(sender) {
+		return false
+	}
+	if r.Subject != nil && !r.Subject.MatchString(subject) {
+		return false
+	}
+	if r.Recipient == nil {
+		return true
+	}
+	for _, recipient := range recipients {
+		if r.Recipient.MatchString(recipient) {
+			return true
+		}
+	}
+	return false
+}
+
+// Target is one endpoint a message should be delivered to and the template to
+// render it with.
+type Target struct {
+	Route    string
+	Endpoint *Endpoint
+	Template *template.Template
+	// Batch is the route's batching, messages are added to its batch rather
+	// than delivered when set
+	Batch *BatchOptions
+	// Limits are the route's size limits
+	Limits *LimitOptions
+}
+
+// Key identifies the target among a message's targets, by its route and
+// endpoint names.
+func (t Target) Key() string {
+	if t.Route == "" {
+		return t.Endpoint.Name
+	}
+	return t.Route + "/" + t.Endpoint.Name
+}
+
+// Targets returns where a message should be delivered, in route order. Without
+// routes every message goes to the default endpoint, with routes a message
+// that matches none of them has no targets.
+func (c *Config) Targets(sender string, recipients []string, subject string) []Target {
+	if len(c.Routes) == 0 {
+		return []Target{{Endpoint: &c.Endpoint, Template: c.Template}}
+	}
+	var targets []Target
+	for _, route := range c.Routes {
+		if !route.Matches(sender, recipients, subject) {
+			continue
+		}
+		targets = append(targets, route.Targets()...)
+		if !route.Continue {
+			break
+		}
+	}
+	return targets
+}
+
+// Targets returns the route's endpoints and the templates to render for them
+func (r *Route) Targets() []Target {
+	var targets []Target
+	for _, endpoint := range r.Endpoints {
+		tmpl := r.Template
+		if tmpl == nil {
+			tmpl = endpoint.Template
+		}
+		targets = append(targets, Target{Route: r.Name, Endpoint: endpoint, Template: tmpl, Batch: r.Batch, Limits: r.Limits})
+	}
+	return targets
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"net/mail"
+	"regexp"
+)
+
+// Rule actions. Drop accepts a message without delivering it, reject refuses
+// it, route-to delivers it to Route instead of the matching routes and set
+// only sets variables.
+const (
+	RuleDrop    = "drop"
+	RuleReject  = "reject"
+	RuleRouteTo = "route-to"
+	RuleSet     = "set"
+)
+
+// Rule acts on messages matching all of its patterns and sizes, nil patterns
+// and zero sizes match anything. Rules are checked in order, after a set rule
+// the next is checked, any other action is the last.
+type Rule struct {
+	Name      string
+	Sender    *regexp.Regexp
+	Recipient *regexp.Regexp
+	Subject   *regexp.Regexp
+	Body      *regexp.Regexp
+	// Headers match any value of each header, keys are canonical
+	Headers map[string]*regexp.Regexp
+	MinSize int
+	MaxSize int
+	Action  string
+	// Route is where route-to rules send messages
+	Route *Route
+	// Vars are set for templates, whatever the action
+	Vars map[string]string
+	// Message is the reply for reject rules
+	Message string
+}
+
+// RuleMessage is what rules match on. Body is matched against Text too, so
+// encoded bodies match.
+type RuleMessage struct {
+	Sender     string
+	Recipients []string
+	Header     mail.Header
+	Body       string
+	Text       string
+	Size       int
+}
+
+// Matches reports whether the rule applies to the message, the recipient
+// pattern must match at least one recipient.
+func (r *Rule) Matches(msg *RuleMessage) bool {
+	if r.Sender != nil && !r.Sender.MatchString(msg.Sender) {
+		return false
+	}
+	if r.Subject != nil && !r.Subject.MatchString(msg.Header.Get("Subject")) {
+		return false
+	}
+	if r.Body != nil && !r.Body.MatchString(msg.Body) && !r.Body.MatchString(msg.Text) {
+		return false
+	}
+	if r.MinSize > 0 && msg.Size < r.MinSize {
+		return false
+	}
+	if r.MaxSize > 0 && msg.Size > r.MaxSize {
+		return false
+	}
+	for name, re := range r.Headers {
+		if !anyMatch(re, msg.Header[name]) {
+			return false
+		}
+	}
+	return r.Recipient == nil || anyMatch(r.Recipient, msg.Recipients)
+}
+
+func anyMatch(re *regexp.Regexp, values []string) bool {
+	for _, value := range values {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyRules returns the variables set by the rules matching msg, and the
+// rule that stopped checking, if any did.
+func (c *Config) ApplyRules(msg *RuleMessage) (map[string]string, *Rule) {
+	vars := map[string]string{}
+	for _, rule := range c.Rules {
+		if !rule.Matches(msg) {
+			continue
+		}
+		for k, v := range rule.Vars {
+			vars[k] = v
+		}
+		if rule.Action != RuleSet {
+			return vars, rule
+		}
+	}
+	return vars, nil
+}
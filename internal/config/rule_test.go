@@ -0,0 +1,100 @@
+package config_test
+
+import (
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"net/mail"
+	"testing"
+)
+
+const rulesFile = `routes:
+  - name: pager
+    endpoints: a
+  - name: everything
+    endpoints: a
+
+rules:
+  - name: cron-noise
+    subject: ^Cron <root@\S+> run-parts
+    action: drop
+  - name: severity
+    body: FAILED
+    set: {severity: critical}
+  - name: escalate
+    body: FAILED
+    action: route-to
+    route: pager
+  - name: huge
+    min-size: 1000
+    header: {x-mailer: ^spammer}
+    action: reject
+    message: No thanks
+`
+
+func TestBuildRules(t *testing.T) {
+	assert := assert.New(t)
+
+	file, err := config.LoadFile(writeFile(t, "pigeon.yaml", rulesFile))
+	if !assert.Nil(err) {
+		return
+	}
+	routes, err := file.BuildRoutes(map[string]*config.Endpoint{"a": {Name: "a"}}, nil)
+	assert.Nil(err)
+	cfg := &config.Config{Routes: routes}
+	cfg.Rules, err = file.BuildRules(routes)
+	if !assert.Nil(err) {
+		return
+	}
+
+	message := func(subject string, body string, size int) *config.RuleMessage {
+		return &config.RuleMessage{
+			Sender: "root@host",
+			Header: mail.Header{"Subject": {subject}, "X-Mailer": {"spammer 1.0"}},
+			Body:   body,
+			Size:   size,
+		}
+	}
+
+	vars, rule := cfg.ApplyRules(message("Cron <root@web1> run-parts /etc/cron.daily", "", 10))
+	assert.Equal("cron-noise", rule.Name)
+	assert.Empty(vars)
+
+	vars, rule = cfg.ApplyRules(message("backup", "backup FAILED", 10))
+	assert.Equal(config.RuleRouteTo, rule.Action)
+	assert.Equal(routes[0], rule.Route)
+	assert.Equal(map[string]string{"severity": "critical"}, vars)
+
+	_, rule = cfg.ApplyRules(message("backup", "", 2000))
+	assert.Equal("No thanks", rule.Message)
+
+	vars, rule = cfg.ApplyRules(message("backup", "ok", 10))
+	assert.Nil(rule)
+	assert.Empty(vars)
+}
+
+func TestBuildRulesErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		content string
+		err     string
+	}{
+		{"rules:\n  - subject: x\n", `:2: rule "1" has no action`},
+		{"rules:\n  - action: explode\n", `:2: rule "1": action must be drop, reject, route-to or set, got "explode"`},
+		{"rules:\n  - action: route-to\n    route: nowhere\n", `:3: rule "1": unknown route "nowhere"`},
+		{"rules:\n  - action: drop\n    message: bye\n", `:3: rule "1": message is only used by reject`},
+		{"rules:\n  - action: drop\n    body: (\n", `:3: rule "1": could not parse body pattern`},
+	}
+	for _, c := range cases {
+		file, err := config.LoadFile(writeFile(t, "pigeon.yaml", c.content))
+		if assert.Nil(err) {
+			_, err = file.BuildRules(nil)
+			if assert.NotNil(err, c.content) {
+				assert.Contains(err.Error(), c.err)
+			}
+		}
+	}
+
+	_, err := config.LoadFile(writeFile(t, "pigeon.yaml", "rules:\n  - action: drop\n    colour: red\n"))
+	assert.ErrorContains(err, `:3: rule "1": unknown option "colour"`)
+}
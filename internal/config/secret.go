@@ -0,0 +1,26 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readSecret reads a secret from a file, or failing that an environment
+// variable. Trailing newlines are trimmed from files.
+func readSecret(file string, env string) (string, error) {
+	var secret string
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("Could not read secret: %v", err)
+		}
+		secret = strings.TrimRight(string(b), "\r\n")
+	} else {
+		secret = os.Getenv(env)
+	}
+	if secret == "" {
+		return "", fmt.Errorf("Secret is empty")
+	}
+	return secret, nil
+}
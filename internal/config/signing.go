@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SigningOptions configures HMAC signing of HTTP request bodies
+type SigningOptions struct {
+	Style           string // "stripe" (t=...,v1=...) or "github" (sha256=...)
+	Algorithm       string // "sha256" or "sha512"
+	Header          string
+	TimestampHeader string
+	SecretFile      string
+	SecretEnv       string
+}
+
+// Enabled reports whether a secret has been configured
+func (opts *SigningOptions) Enabled() bool {
+	return opts != nil && (opts.SecretFile != "" || opts.SecretEnv != "")
+}
+
+// Validate checks the options are usable and fills in the default header for
+// the style.
+func (opts *SigningOptions) Validate() error {
+	if !opts.Enabled() {
+		return nil
+	}
+	opts.Style = strings.ToLower(opts.Style)
+	opts.Algorithm = strings.ToLower(opts.Algorithm)
+	switch opts.Algorithm {
+	case "sha256", "sha512":
+	default:
+		return fmt.Errorf("Signing algorithm must be sha256 or sha512, got %q", opts.Algorithm)
+	}
+	switch opts.Style {
+	case "stripe":
+		if opts.Header == "" {
+			opts.Header = "X-Signature"
+		}
+	case "github":
+		if opts.Header == "" {
+			opts.Header = "X-Hub-Signature-" + strings.TrimPrefix(opts.Algorithm, "sha")
+		}
+	default:
+		return fmt.Errorf("Signing style must be stripe or github, got %q", opts.Style)
+	}
+	if opts.SecretFile != "" && opts.SecretEnv != "" {
+		return fmt.Errorf("Signing secret must be given as a file or an environment variable, not both")
+	}
+	_, err := opts.Secret()
+	return err
+}
+
+// Secret reads the signing secret, it is re-read for each message so the file
+// or variable may be rotated without a restart.
+func (opts *SigningOptions) Secret() ([]byte, error) {
+	secret, err := readSecret(opts.SecretFile, opts.SecretEnv)
+	if err != nil {
+		return nil, fmt.Errorf("Signing: %v", err)
+	}
+	return []byte(secret), nil
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// LoadTemplateDir parses every file in dir, other than directories and
+// hidden files, into one set. Each file is named after its file name and
+// may define more templates, which every template in the set may include.
+func LoadTemplateDir(dir string, access *TemplateAccess) (*template.Template, error) {
+	paths, err := TemplateDirFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("Template directory %v has no templates", dir)
+	}
+	set := template.New("").Funcs(funcMap(access))
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read template file: %v", err)
+		}
+		if _, err := set.New(filepath.Base(path)).Parse(string(b)); err != nil {
+			return nil, fmt.Errorf("Could not parse template: %v", err)
+		}
+	}
+	if err := access.check(set); err != nil {
+		return nil, fmt.Errorf("Could not parse template: %v", err)
+	}
+	return set, nil
+}
+
+// TemplateDirFiles lists the files LoadTemplateDir reads, sorted by name
+func TemplateDirFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read template directory: %v", err)
+	}
+	var paths []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, entry.Name()))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// NamedTemplate picks a template from access's partials to use as a body
+func NamedTemplate(name string, access *TemplateAccess) (*template.Template, error) {
+	if access == nil || access.Partials == nil {
+		return nil, fmt.Errorf("Template %q needs --template-dir", name)
+	}
+	tmpl := access.Partials.Lookup(name)
+	if tmpl == nil || tmpl.Tree == nil {
+		return nil, fmt.Errorf("No template %q in --template-dir", name)
+	}
+	return tmpl, nil
+}
+
+// CheckTemplates makes sure every {{template}} action in the set names a
+// template that exists, which text/template only notices when the action
+// runs.
+func CheckTemplates(tmpl *template.Template) error {
+	return walkTemplates(tmpl, func(t *template.Template, node parse.Node) error {
+		include, ok := node.(*parse.TemplateNode)
+		if !ok {
+			return nil
+		}
+		if found := tmpl.Lookup(include.Name); found == nil || found.Tree == nil {
+			location, _ := t.ErrorContext(include)
+			return fmt.Errorf("%s: no template %q", location, include.Name)
+		}
+		return nil
+	})
+}
+
+// walkTemplates calls visit with every node of every template in the set
+func walkTemplates(tmpl *template.Template, visit func(*template.Template, parse.Node) error) error {
+	templates := tmpl.Templates()
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].Name() < templates[j].Name()
+	})
+	for _, t := range templates {
+		if t.Tree == nil || t.Tree.Root == nil {
+			continue
+		}
+		if err := walkNode(t, t.Tree.Root, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkNode(tmpl *template.Template, node parse.Node, visit func(*template.Template, parse.Node) error) error {
+	if err := visit(tmpl, node); err != nil {
+		return err
+	}
+	var children []parse.Node
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			children = n.Nodes
+		}
+	case *parse.ActionNode:
+		children = []parse.Node{n.Pipe}
+	case *parse.IfNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.RangeNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.WithNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.TemplateNode:
+		children = []parse.Node{n.Pipe}
+	case *parse.PipeNode:
+		if n != nil {
+			for _, cmd := range n.Cmds {
+				children = append(children, cmd)
+			}
+		}
+	case *parse.ChainNode:
+		children = []parse.Node{n.Node}
+	case *parse.CommandNode:
+		children = n.Args
+	}
+	for _, child := range children {
+		if child == nil {
+			continue
+		}
+		if err := walkNode(tmpl, child, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package config_test
+
+import (
+	"bytes"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func templateDir(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadTemplateDir(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := templateDir(t, map[string]string{
+		"helpers.tmpl": `{{define "footer"}}-- {{.}}{{end}}`,
+		"slack.tmpl":   `{{.}} {{template "footer" "pigeon"}}`,
+		".swp":         `{{`,
+	})
+	os.Mkdir(filepath.Join(dir, "old"), 0700)
+	access := &config.TemplateAccess{}
+	set, err := config.LoadTemplateDir(dir, access)
+	if !assert.Nil(err) {
+		return
+	}
+	access.Partials = set
+
+	var out bytes.Buffer
+	slack, err := config.NamedTemplate("slack.tmpl", access)
+	if assert.Nil(err) {
+		assert.Nil(slack.Execute(&out, "hi"))
+		assert.Equal("hi -- pigeon", out.String())
+	}
+	_, err = config.NamedTemplate("teams.tmpl", access)
+	assert.EqualError(err, `No template "teams.tmpl" in --template-dir`)
+
+	// inline templates may include partials without adding to the set
+	body, err := config.ParseTemplate("post-template", `{{template "footer" .}}`, access)
+	if assert.Nil(err) {
+		out.Reset()
+		assert.Nil(body.Execute(&out, "inline"))
+		assert.Equal("-- inline", out.String())
+	}
+	assert.Nil(set.Lookup("post-template"))
+}
+
+func TestLoadTemplateDirErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := config.LoadTemplateDir(templateDir(t, nil), nil)
+	assert.ErrorContains(err, "has no templates")
+	_, err = config.LoadTemplateDir(templateDir(t, map[string]string{"a.tmpl": `{{.Body`}), nil)
+	assert.ErrorContains(err, "Could not parse template: template: a.tmpl:1")
+	_, err = config.LoadTemplateDir(templateDir(t, map[string]string{"a.tmpl": `{{env "HOME"}}`}), nil)
+	assert.ErrorContains(err, `"HOME" is not allowed`)
+	_, err = config.NamedTemplate("a.tmpl", nil)
+	assert.EqualError(err, `Template "a.tmpl" needs --template-dir`)
+}
+
+func TestCheckTemplates(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpl, _ := config.ParseTemplate("body", `{{define "a"}}a{{end}}{{if .}}{{template "a"}}{{else}}{{template "b" .}}{{end}}`, nil)
+	assert.EqualError(config.CheckTemplates(tmpl), `body:1:65: no template "b"`)
+
+	tmpl, _ = config.ParseTemplate("body", `{{define "b"}}b{{end}}{{template "b" .}}`, nil)
+	assert.Nil(config.CheckTemplates(tmpl))
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig builds the client TLS configuration for the options, loading any
+// CA bundle and client certificate from disk.
+func (opts *HTTPOptions) TLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if opts.MinTLSVersion != "" {
+		version, ok := tlsVersions[opts.MinTLSVersion]
+		if !ok {
+			return nil, fmt.Errorf("TLS minimum version must be one of 1.0, 1.1, 1.2 or 1.3, got %q", opts.MinTLSVersion)
+		}
+		cfg.MinVersion = version
+	}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %q contains no PEM certificates", opts.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	switch {
+	case opts.CertFile != "" && opts.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	case opts.CertFile != "" || opts.KeyFile != "":
+		return nil, fmt.Errorf("Client certificate and key must be given together")
+	}
+
+	if len(opts.PinnedSPKI) > 0 {
+		pins := map[string]bool{}
+		for _, pin := range opts.PinnedSPKI {
+			pin = strings.TrimPrefix(pin, "sha256/")
+			if raw, err := base64.StdEncoding.DecodeString(pin); err != nil || len(raw) != sha256.Size {
+				return nil, fmt.Errorf("SPKI pins must be base64 encoded SHA-256 digests, got %q", pin)
+			}
+			pins[pin] = true
+		}
+		// pins are checked in addition to normal chain verification, and only
+		// against verified chains, as anyone can send a pinned certificate
+		// alongside their own
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					if pins[base64.StdEncoding.EncodeToString(digest[:])] {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("no verified certificate chain from %v contains a pinned public key", cs.ServerName)
+		}
+	}
+
+	return cfg, nil
+}
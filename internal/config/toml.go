@@ -0,0 +1,220 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+	"gopkg.in/yaml.v3"
+	"strconv"
+	"strings"
+)
+
+// parseTOML converts a TOML document into the node tree YAML files produce, so
+// both formats share decoding and report errors by line.
+func parseTOML(b []byte) (*yaml.Node, error) {
+	t := &tomlConverter{
+		root:    &yaml.Node{Kind: yaml.MappingNode, Line: 1},
+		defined: map[*yaml.Node]bool{},
+		inline:  map[*yaml.Node]bool{},
+	}
+	t.p.Reset(b)
+	// key values belong to the most recent [table] or [[array table]]
+	current := t.root
+	for t.p.NextExpression() {
+		expr := t.p.Expression()
+		var err error
+		switch expr.Kind {
+		case unstable.Table:
+			current, err = t.table(expr, false)
+		case unstable.ArrayTable:
+			current, err = t.table(expr, true)
+		case unstable.KeyValue:
+			err = t.keyValue(current, expr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := t.p.Error(); err != nil {
+		line := bytes.Count(b, []byte("\n")) + 1
+		if perr, ok := err.(*unstable.ParserError); ok && perr.Highlight != nil {
+			line = t.p.Shape(t.p.Range(perr.Highlight)).Start.Line
+		}
+		return nil, fmt.Errorf("line %d: %v", line, err)
+	}
+	// the converter keeps lines but only checks what it relies on, the
+	// decoder checks the rest of the spec
+	var doc map[string]any
+	if err := toml.Unmarshal(b, &doc); err != nil {
+		var derr *toml.DecodeError
+		if errors.As(err, &derr) {
+			line, _ := derr.Position()
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		return nil, err
+	}
+	return t.root, nil
+}
+
+type tomlConverter struct {
+	p    unstable.Parser
+	root *yaml.Node
+	// defined are the tables that can't be given a [table] header again,
+	// those that already had one or were defined by keys, and inline tables
+	// which can't be added to at all
+	defined map[*yaml.Node]bool
+	inline  map[*yaml.Node]bool
+}
+
+func (t *tomlConverter) line(n *unstable.Node) int {
+	return t.p.Shape(n.Raw).Start.Line
+}
+
+// table finds or creates the mapping for a [table], or appends a new mapping
+// for an [[array table]].
+func (t *tomlConverter) table(expr *unstable.Node, array bool) (*yaml.Node, error) {
+	keys := expr.Key()
+	node := t.root
+	for keys.Next() {
+		key := keys.Node()
+		line := t.line(key)
+		child := mappingValue(node, string(key.Data))
+		if t.inline[child] {
+			return nil, fmt.Errorf("line %d: %q is defined more than once", line, key.Data)
+		}
+		if keys.IsLast() && array {
+			if child == nil {
+				child = &yaml.Node{Kind: yaml.SequenceNode, Line: line}
+				addMapping(node, string(key.Data), line, child)
+			} else if child.Kind != yaml.SequenceNode {
+				return nil, fmt.Errorf("line %d: %q is not an array of tables", line, key.Data)
+			}
+			table := &yaml.Node{Kind: yaml.MappingNode, Line: line}
+			child.Content = append(child.Content, table)
+			return table, nil
+		}
+		if keys.IsLast() {
+			if child != nil && (child.Kind != yaml.MappingNode || t.defined[child]) {
+				return nil, fmt.Errorf("line %d: %q is defined more than once", line, key.Data)
+			}
+			if child == nil {
+				child = &yaml.Node{Kind: yaml.MappingNode, Line: line}
+				addMapping(node, string(key.Data), line, child)
+			}
+			t.defined[child] = true
+			return child, nil
+		}
+		if child == nil {
+			child = &yaml.Node{Kind: yaml.MappingNode, Line: line}
+			addMapping(node, string(key.Data), line, child)
+		}
+		if child.Kind == yaml.SequenceNode && len(child.Content) > 0 {
+			// [a.b] after [[a]] refers to the last a
+			child = child.Content[len(child.Content)-1]
+		}
+		if child.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("line %d: %q is not a table", line, key.Data)
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// keyValue adds a key, which may be dotted, and its value to the table
+func (t *tomlConverter) keyValue(table *yaml.Node, expr *unstable.Node) error {
+	keys := expr.Key()
+	node := table
+	for keys.Next() {
+		key := keys.Node()
+		line := t.line(key)
+		child := mappingValue(node, string(key.Data))
+		if keys.IsLast() {
+			if child != nil {
+				return fmt.Errorf("line %d: %q is defined more than once", line, key.Data)
+			}
+			value, err := t.value(expr.Value(), line)
+			if err != nil {
+				return err
+			}
+			addMapping(node, string(key.Data), line, value)
+			return nil
+		}
+		if child == nil {
+			child = &yaml.Node{Kind: yaml.MappingNode, Line: line}
+			addMapping(node, string(key.Data), line, child)
+			t.defined[child] = true
+		} else if child.Kind != yaml.MappingNode || t.inline[child] {
+			return fmt.Errorf("line %d: %q is not a table", line, key.Data)
+		}
+		node = child
+	}
+	return nil
+}
+
+// value converts a value, line is that of its key as values don't carry
+// their own position.
+func (t *tomlConverter) value(v *unstable.Node, line int) (*yaml.Node, error) {
+	switch v.Kind {
+	case unstable.Array:
+		seq := &yaml.Node{Kind: yaml.SequenceNode, Line: line}
+		children := v.Children()
+		for children.Next() {
+			item, err := t.value(children.Node(), line)
+			if err != nil {
+				return nil, err
+			}
+			seq.Content = append(seq.Content, item)
+		}
+		return seq, nil
+	case unstable.InlineTable:
+		table := &yaml.Node{Kind: yaml.MappingNode, Line: line}
+		children := v.Children()
+		for children.Next() {
+			if err := t.keyValue(table, children.Node()); err != nil {
+				return nil, err
+			}
+		}
+		t.defined[table], t.inline[table] = true, true
+		return table, nil
+	case unstable.Integer:
+		text := strings.ReplaceAll(string(v.Data), "_", "")
+		// base 0 understands TOML's 0x, 0o and 0b prefixes
+		n, err := strconv.ParseInt(text, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid integer %q", line, v.Data)
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.FormatInt(n, 10), Line: line}, nil
+	case unstable.Float:
+		text := strings.ReplaceAll(string(v.Data), "_", "")
+		// YAML spells TOML's inf and nan with a leading dot
+		switch strings.TrimLeft(text, "+-") {
+		case "inf":
+			text = strings.TrimSuffix(text, "inf") + ".inf"
+		case "nan":
+			text = ".nan"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: text, Line: line}, nil
+	case unstable.Bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: string(v.Data), Line: line}, nil
+	default:
+		// strings, and dates which are only ever used as strings
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: string(v.Data), Line: line}, nil
+	}
+}
+
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func addMapping(mapping *yaml.Node, key string, line int, value *yaml.Node) {
+	mapping.Content = append(mapping.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key, Line: line},
+		value)
+}
@@ -0,0 +1,136 @@
+package dispatch
+
+import (
+	"errors"
+	"expvar"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without attempting delivery while an endpoint's
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open, endpoint is failing")
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// circuit state per endpoint and server and how often each has opened, served
+// by expvar
+var (
+	circuitStates = expvar.NewMap("circuit_breaker_state")
+	circuitOpens  = expvar.NewMap("circuit_breaker_opens")
+)
+
+// breaker stops delivery attempts to an endpoint after Threshold consecutive
+// failures. After OpenFor a single probe is let through, if it succeeds the
+// circuit closes, otherwise it stays open for another OpenFor.
+type breaker struct {
+	sync.Mutex
+	name     string
+	opts     config.BreakerOptions
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+// breakers are kept per endpoint and server rather than per options, so
+// reloads keep the state of endpoints that still exist.
+type breakerKey struct {
+	endpoint string
+	server   string
+}
+
+var breakers = struct {
+	sync.Mutex
+	shared map[breakerKey]*breaker
+}{shared: map[breakerKey]*breaker{}}
+
+// breakerFor returns the endpoint's breaker for the target's server, or nil if
+// breakers are disabled. Changed options apply to an existing breaker without
+// resetting it.
+func breakerFor(endpoint string, opts *config.BreakerOptions, target *url.URL) *breaker {
+	if !opts.Enabled() {
+		return nil
+	}
+	server := serverName(target)
+	key := breakerKey{endpoint: endpoint, server: server}
+
+	breakers.Lock()
+	defer breakers.Unlock()
+	if b, ok := breakers.shared[key]; ok {
+		b.Lock()
+		b.opts = *opts
+		b.Unlock()
+		return b
+	}
+	b := &breaker{name: metricName(endpoint, server), opts: *opts, state: circuitClosed}
+	breakers.shared[key] = b
+	circuitStates.Set(b.name, stateVar(circuitClosed))
+	return b
+}
+
+// allow reports whether a delivery may be attempted.
+func (b *breaker) allow() error {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.opts.OpenFor {
+			return ErrCircuitOpen
+		}
+		b.transition(circuitHalfOpen)
+		return nil
+	case circuitHalfOpen:
+		// a probe is already in flight
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of an allowed delivery.
+func (b *breaker) record(success bool) {
+	b.Lock()
+	defer b.Unlock()
+	if success {
+		b.failures = 0
+		if b.state != circuitClosed {
+			b.transition(circuitClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.opts.Threshold {
+		b.openedAt = time.Now()
+		if b.state != circuitOpen {
+			b.transition(circuitOpen)
+			circuitOpens.Add(b.name, 1)
+		}
+	}
+}
+
+// cancel returns a half-open breaker to open when its probe was never made.
+func (b *breaker) cancel() {
+	b.Lock()
+	defer b.Unlock()
+	if b.state == circuitHalfOpen {
+		b.transition(circuitOpen)
+	}
+}
+
+func (b *breaker) transition(state string) {
+	log.Printf("Circuit breaker for %v: %v -> %v (%d consecutive failures)", b.name, b.state, state, b.failures)
+	b.state = state
+	circuitStates.Set(b.name, stateVar(state))
+}
+
+func stateVar(state string) *expvar.String {
+	v := new(expvar.String)
+	v.Set(state)
+	return v
+}
@@ -0,0 +1,162 @@
+package dispatch
+
+import (
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestDeliverCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+
+	var hits int32
+	var failing atomic.Bool
+	failing.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	ep := makeEndpoint(server.URL, nil)
+	ep.Breaker = &config.BreakerOptions{Threshold: 2, OpenFor: 50 * time.Millisecond}
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	deliver := func() error {
+		_, _, err := Deliver(ep, tmpl, makeTemplateData())
+		return err
+	}
+
+	// failures are counted until the threshold
+	assert.ErrorIs(deliver(), ErrUnavailable)
+	assert.ErrorIs(deliver(), ErrUnavailable)
+	assert.Equal(int32(2), atomic.LoadInt32(&hits))
+
+	// then the endpoint is not contacted
+	assert.ErrorIs(deliver(), ErrCircuitOpen)
+	assert.Equal(int32(2), atomic.LoadInt32(&hits))
+
+	// a failed probe re-opens the circuit
+	time.Sleep(60 * time.Millisecond)
+	assert.ErrorIs(deliver(), ErrUnavailable)
+	assert.Equal(int32(3), atomic.LoadInt32(&hits))
+	assert.ErrorIs(deliver(), ErrCircuitOpen)
+
+	// a successful probe closes it
+	failing.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	assert.Nil(deliver())
+	assert.Nil(deliver())
+	assert.Equal(int32(5), atomic.LoadInt32(&hits))
+}
+
+func TestDeliverCircuitBreakerIgnoresClientErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	ep := makeEndpoint(server.URL, nil)
+	ep.Breaker = &config.BreakerOptions{Threshold: 1, OpenFor: time.Minute}
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	for i := 0; i < 3; i++ {
+		_, _, err := Deliver(ep, tmpl, makeTemplateData())
+		assert.Nil(err)
+	}
+}
+
+func TestCircuitBreakerSurvivesReload(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	ep := makeEndpoint(server.URL, nil)
+	ep.Name = "reloaded-breaker"
+	ep.Breaker = &config.BreakerOptions{Threshold: 1, OpenFor: time.Minute}
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	_, _, err := Deliver(ep, tmpl, makeTemplateData())
+	assert.ErrorIs(err, ErrUnavailable)
+
+	// a reload builds new options, the circuit stays open
+	reloaded := *ep
+	reloaded.Breaker = &config.BreakerOptions{Threshold: 1, OpenFor: time.Minute}
+	_, _, err = Deliver(&reloaded, tmpl, makeTemplateData())
+	assert.ErrorIs(err, ErrCircuitOpen)
+
+	// changed options apply to the open circuit, the probe gets through
+	reloaded.Breaker = &config.BreakerOptions{Threshold: 1, OpenFor: time.Millisecond}
+	time.Sleep(5 * time.Millisecond)
+	_, _, err = Deliver(&reloaded, tmpl, makeTemplateData())
+	assert.ErrorIs(err, ErrUnavailable)
+}
+
+func TestCircuitBreakerIgnoresTemplateErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer server.Close()
+
+	ep := makeEndpoint(server.URL, nil)
+	ep.Breaker = &config.BreakerOptions{Threshold: 1, OpenFor: time.Minute}
+	broken := template.Must(template.New("test").Parse(`{{template "missing"}}`))
+	for i := 0; i < 3; i++ {
+		_, _, err := Deliver(ep, broken, makeTemplateData())
+		assert.NotNil(err)
+		assert.NotErrorIs(err, ErrCircuitOpen)
+	}
+
+	// too many requests is the endpoint's fault
+	tooMany := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer tooMany.Close()
+	ep = makeEndpoint(tooMany.URL, nil)
+	ep.Breaker = &config.BreakerOptions{Threshold: 1, OpenFor: time.Minute}
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	_, _, err := Deliver(ep, tmpl, makeTemplateData())
+	assert.ErrorIs(err, ErrUnavailable)
+	_, _, err = Deliver(ep, tmpl, makeTemplateData())
+	assert.ErrorIs(err, ErrCircuitOpen)
+	assert.Equal(int32(1), atomic.LoadInt32(&hits))
+}
+
+func TestCircuitBreakerMetricsPerEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	failing := makeEndpoint(server.URL, nil)
+	failing.Name = "metrics-failing"
+	failing.Breaker = &config.BreakerOptions{Threshold: 1, OpenFor: time.Minute}
+	patient := makeEndpoint(server.URL, nil)
+	patient.Name = "metrics-patient"
+	patient.Breaker = &config.BreakerOptions{Threshold: 5, OpenFor: time.Minute}
+	Deliver(failing, tmpl, makeTemplateData())
+	Deliver(patient, tmpl, makeTemplateData())
+
+	// both endpoints use the same server, each has its own state
+	addr := "http://" + server.Listener.Addr().String()
+	assert.Equal(`"open"`, circuitStates.Get("metrics-failing/"+addr).String())
+	assert.Equal(`"closed"`, circuitStates.Get("metrics-patient/"+addr).String())
+	assert.Equal("1", circuitOpens.Get("metrics-failing/"+addr).String())
+	assert.Nil(circuitOpens.Get("metrics-patient/" + addr))
+}
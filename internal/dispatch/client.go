@@ -0,0 +1,120 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+var defaultHTTPOptions = config.DefaultHTTPOptions()
+
+type clientKey struct {
+	endpoint string
+	socket   string
+}
+
+// sharedClient is a client and a copy of the options it was made with
+type sharedClient struct {
+	opts   config.HTTPOptions
+	client *http.Client
+}
+
+// clients are shared by every request to an endpoint (and unix socket) so
+// connections are kept alive and reused. They are kept per endpoint rather
+// than per options so reloads reuse them while the options are unchanged.
+var clients = struct {
+	sync.Mutex
+	shared map[clientKey]*sharedClient
+}{shared: map[clientKey]*sharedClient{}}
+
+// clientFor returns the endpoint's shared client, nil options use the
+// defaults. If socket is given all connections are made to that unix socket.
+// When the options have changed the old client is replaced and its idle
+// connections closed.
+func clientFor(endpoint string, opts *config.HTTPOptions, socket string) (*http.Client, error) {
+	if opts == nil {
+		opts = defaultHTTPOptions
+	}
+	key := clientKey{endpoint: endpoint, socket: socket}
+
+	clients.Lock()
+	defer clients.Unlock()
+	old, ok := clients.shared[key]
+	if ok && reflect.DeepEqual(old.opts, *opts) {
+		return old.client, nil
+	}
+
+	tlsConfig, err := opts.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := opts.ProxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   opts.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = proxy
+	transport.DialContext = dialer.DialContext
+	transport.MaxIdleConnsPerHost = 4
+	if socket != "" {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+
+	maxRedirects := opts.MaxRedirects
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   opts.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if maxRedirects == 0 {
+				// hand the redirect response back to the caller as is
+				return http.ErrUseLastResponse
+			}
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return nil
+		},
+	}
+	if ok {
+		old.client.CloseIdleConnections()
+	}
+	clients.shared[key] = &sharedClient{opts: *opts, client: client}
+	return client, nil
+}
+
+// splitUnixURL converts "unix:///path/to.sock:/http/path" into an HTTP URL
+// and the socket to connect to. Other URLs are returned unchanged.
+func splitUnixURL(rawURL string) (string, string, error) {
+	rest, ok := strings.CutPrefix(rawURL, "unix://")
+	if !ok {
+		return rawURL, "", nil
+	}
+	socket, path, ok := strings.Cut(rest, ":")
+	if !ok || socket == "" {
+		return "", "", fmt.Errorf("unix URLs must be in the form unix:///path/to.sock:/http/path, got %q", rawURL)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	// the host is only used for the Host header, connections go to the socket
+	target, err := url.Parse("http://localhost" + path)
+	if err != nil {
+		return "", "", err
+	}
+	return target.String(), socket, nil
+}
@@ -0,0 +1,68 @@
+package dispatch
+
+import (
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"text/template"
+)
+
+func TestSplitUnixURL(t *testing.T) {
+	assert := assert.New(t)
+
+	target, socket, err := splitUnixURL("unix:///run/agent.sock:/hooks/mail?x=1")
+	assert.Nil(err)
+	assert.Equal("http://localhost/hooks/mail?x=1", target)
+	assert.Equal("/run/agent.sock", socket)
+
+	target, socket, err = splitUnixURL("https://example.com/hook")
+	assert.Nil(err)
+	assert.Equal("https://example.com/hook", target)
+	assert.Equal("", socket)
+
+	_, _, err = splitUnixURL("unix:///run/agent.sock")
+	assert.NotNil(err)
+}
+
+func TestRequestUnixSocket(t *testing.T) {
+	assert := assert.New(t)
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.Nil(err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/hooks/mail", r.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	status, err := Request(makeEndpoint("unix://"+socket+":/hooks/mail", nil), tmpl, makeTemplateData())
+	assert.Nil(err)
+	assert.Equal(http.StatusAccepted, status)
+}
+
+func TestRequestThroughProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	// plain http requests are sent to the proxy with an absolute URI
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("http://endpoint.invalid/mail", r.URL.String())
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer proxy.Close()
+
+	opts := config.DefaultHTTPOptions()
+	opts.Proxy = proxy.URL
+	assert.Nil(opts.Validate())
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	status, err := Request(makeEndpoint("http://endpoint.invalid/mail", opts), tmpl, makeTemplateData())
+	assert.Nil(err)
+	assert.Equal(http.StatusAccepted, status)
+}
@@ -0,0 +1,70 @@
+package dispatch
+
+import (
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestRequestCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	payload := strings.Repeat("hey guys running L8 2DAY\n", 100)
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		switch r.Header.Get("Content-Encoding") {
+		case "gzip":
+			body, _ = gzip.NewReader(r.Body)
+		case "zstd":
+			decoder, _ := zstd.NewReader(r.Body)
+			defer decoder.Close()
+			body = decoder
+		}
+		b, _ := io.ReadAll(body)
+		assert.Equal(payload, string(b))
+		received = r.Header.Get("Content-Encoding")
+	}))
+	defer server.Close()
+
+	data := makeTemplateData()
+	data.Body = payload
+	tmpl := template.Must(template.New("test").Parse("{{.Body}}"))
+
+	for _, encoding := range []string{"gzip", "zstd"} {
+		opts := config.DefaultHTTPOptions()
+		opts.Compression = encoding
+		opts.CompressAbove = 100
+		status, err := Request(makeEndpoint(server.URL, opts), tmpl, data)
+		assert.Nil(err, encoding)
+		assert.Equal(200, status, encoding)
+		assert.Equal(encoding, received)
+	}
+
+	// small bodies are sent as is
+	opts := config.DefaultHTTPOptions()
+	opts.Compression = "gzip"
+	opts.CompressAbove = len(payload)
+	status, err := Request(makeEndpoint(server.URL, opts), tmpl, data)
+	assert.Nil(err)
+	assert.Equal(200, status)
+	assert.Equal("", received)
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	compressed, err := compress("gzip", []byte("pigeon"))
+	assert.Nil(err)
+	r, err := gzip.NewReader(strings.NewReader(string(compressed)))
+	assert.Nil(err)
+	b, _ := io.ReadAll(r)
+	assert.Equal("pigeon", string(b))
+}
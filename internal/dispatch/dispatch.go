@@ -2,9 +2,15 @@ package dispatch
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
 	"text/template"
 	"time"
 	"github.com/rktjmp/smtp-pigeon/internal/config"
@@ -15,48 +21,262 @@ type TemplateData struct {
 	Timestamp  time.Time
 	Sender     string
 	Recipients []string
+	Recipient  Address
 	Data       string
 	Header     mail.Header
+	Subject    string
 	Body       string
+	Text       string
+	HTML       string
+	Responses  []*Response
+	Messages   []*TemplateData
+	Vars       map[string]string
+	Redactions int
 }
 
-type Endpoint struct {
-	URL     *template.Template
-	Headers []config.HeaderPair
+// Address is an email address split into its local and domain parts
+type Address struct {
+	Address string
+	Local   string
+	Domain  string
 }
 
-func POST(endpoint *Endpoint, tmpl *template.Template, data *TemplateData) (int, error) {
+// NewAddress splits an address on its final "@", an address without one is
+// treated as all local part.
+func NewAddress(address string) Address {
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return Address{Address: address, Local: address}
+	}
+	return Address{
+		Address: address,
+		Local:   address[:i],
+		Domain:  address[i+1:],
+	}
+}
+
+// Endpoint is where and how to deliver, see config.Endpoint
+type Endpoint = config.Endpoint
+
+// Deliver renders the endpoint URL and picks a sink by its scheme. HTTP(S)
+// URLs are sent a request, broker URLs are published to. It returns a short
+// status description for logging and, for HTTP, the endpoint's response.
+func Deliver(endpoint *Endpoint, tmpl *template.Template, data *TemplateData) (string, *Response, error) {
+	return DeliverContext(context.Background(), endpoint, tmpl, data)
+}
+
+// DeliverContext is Deliver, giving up waiting on the rate limit or for an
+// HTTP response when ctx is done.
+func DeliverContext(ctx context.Context, endpoint *Endpoint, tmpl *template.Template, data *TemplateData) (string, *Response, error) {
+	var urlBuf bytes.Buffer
+	if err := endpoint.URL.Execute(&urlBuf, data); err != nil {
+		return "", nil, err
+	}
+	target, err := url.Parse(urlBuf.String())
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to parse URL: %v", err)
+	}
+
+	breaker := breakerFor(endpoint.Name, endpoint.Breaker, target)
+	if breaker != nil {
+		if err := breaker.allow(); err != nil {
+			return "", nil, err
+		}
+	}
+	if limiter := limiterFor(endpoint.Name, endpoint.RateLimit, target); limiter != nil {
+		if err := limiter.wait(ctx); err != nil {
+			if breaker != nil {
+				// the probe, if this was one, never happened
+				breaker.cancel()
+			}
+			return "", nil, err
+		}
+	}
+	status, resp, err := deliver(ctx, endpoint, target, tmpl, data)
+	if breaker != nil {
+		var failed *endpointError
+		switch {
+		case errors.As(err, &failed) && ctx.Err() == nil:
+			breaker.record(false)
+		case err != nil:
+			// the endpoint wasn't at fault, eg the template failed or the
+			// delivery was cancelled
+			breaker.cancel()
+		default:
+			// a rejected payload is the payload's fault, not the endpoint's
+			breaker.record(true)
+		}
+	}
+	return status, resp, err
+}
+
+// ErrUnavailable is returned, with the status, when an HTTP endpoint responds
+// 5xx or 429, the message should be delivered again later.
+var ErrUnavailable = errors.New("endpoint unavailable")
+
+// endpointError is a failure to reach the endpoint, read its response or a
+// 5xx or 429 response, as opposed to rendering or configuration errors. Only
+// these count towards the endpoint's circuit breaker.
+type endpointError struct {
+	err error
+}
+
+func (e *endpointError) Error() string {
+	return e.err.Error()
+}
+
+func (e *endpointError) Unwrap() error {
+	return e.err
+}
+
+func deliver(ctx context.Context, endpoint *Endpoint, target *url.URL, tmpl *template.Template, data *TemplateData) (string, *Response, error) {
+	if !isBrokerScheme(target.Scheme) {
+		resp, err := doContext(ctx, endpoint, tmpl, data)
+		if err != nil {
+			return "", nil, err
+		}
+		status := strconv.Itoa(resp.Status)
+		if resp.Status >= 500 || resp.Status == http.StatusTooManyRequests {
+			return status, resp, &endpointError{fmt.Errorf("%w, responded %d", ErrUnavailable, resp.Status)}
+		}
+		return status, resp, nil
+	}
+
 	var bodyBuf bytes.Buffer
 	if err := tmpl.Execute(&bodyBuf, data); err != nil {
+		return "", nil, err
+	}
+	s, err := acquireSink(endpoint.Name, target)
+	if err != nil {
+		return "", nil, &endpointError{err}
+	}
+	status, err := s.sink.publish(endpoint, target, bodyBuf.Bytes(), data)
+	s.release(err != nil)
+	if err != nil {
+		return status, nil, &endpointError{err}
+	}
+	return status, nil, nil
+}
+
+// Request sends the rendered template to the endpoint URL using the configured
+// HTTP method, POST by default, and returns the response status code.
+func Request(endpoint *Endpoint, tmpl *template.Template, data *TemplateData) (int, error) {
+	resp, err := Do(endpoint, tmpl, data)
+	if err != nil {
 		return 0, err
 	}
+	return resp.Status, nil
+}
+
+// Rendering is what the endpoint's templates produce for a message
+type Rendering struct {
+	// Method is the HTTP method, empty for URLs that are published to
+	Method  string
+	URL     string
+	Headers [][2]string
+	Body    []byte
+}
+
+// Render executes the endpoint's URL, header and body templates without
+// delivering anything. Headers are only rendered for HTTP URLs, which are the
+// only ones that send them, and request signatures are not included.
+func Render(endpoint *Endpoint, tmpl *template.Template, data *TemplateData) (*Rendering, error) {
 	var urlBuf bytes.Buffer
 	if err := endpoint.URL.Execute(&urlBuf, data); err != nil {
-		return 0, err
+		return nil, err
+	}
+	var bodyBuf bytes.Buffer
+	if err := tmpl.Execute(&bodyBuf, data); err != nil {
+		return nil, err
+	}
+	r := &Rendering{URL: urlBuf.String(), Body: bodyBuf.Bytes()}
+	if target, err := url.Parse(r.URL); err == nil && isBrokerScheme(target.Scheme) {
+		return r, nil
+	}
+	r.Method = http.MethodPost
+	if endpoint.HTTP != nil {
+		r.Method = endpoint.HTTP.Method
 	}
-	var headers [][2]string
 	for _, header := range endpoint.Headers {
 		var valueBuf bytes.Buffer
 		if err := header.Value.Execute(&valueBuf, data); err != nil {
-			return 0, fmt.Errorf("could not execute header template: %q: %v", header.Key, err)
+			return nil, fmt.Errorf("could not execute header template: %q: %v", header.Key, err)
 		}
-		headers = append(headers, [2]string{
+		r.Headers = append(r.Headers, [2]string{
 			header.Key,
 			valueBuf.String(),
 		})
 	}
-	resp, err := performPOSTRequest(urlBuf.String(), headers, &bodyBuf)
+	return r, nil
+}
+
+// Do is Request, but returns the endpoint's response.
+func Do(endpoint *Endpoint, tmpl *template.Template, data *TemplateData) (*Response, error) {
+	return doContext(context.Background(), endpoint, tmpl, data)
+}
+
+func doContext(ctx context.Context, endpoint *Endpoint, tmpl *template.Template, data *TemplateData) (*Response, error) {
+	rendering, err := Render(endpoint, tmpl, data)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	headers := rendering.Headers
+	opts := endpoint.HTTP
+	if opts == nil {
+		opts = defaultHTTPOptions
+	}
+	target, socket, err := splitUnixURL(rendering.URL)
+	if err != nil {
+		return nil, err
+	}
+	client, err := clientFor(endpoint.Name, opts, socket)
+	if err != nil {
+		return nil, err
+	}
+	body := rendering.Body
+	if opts.Compression != "" && len(body) > opts.CompressAbove {
+		body, err = compress(opts.Compression, body)
+		if err != nil {
+			return nil, fmt.Errorf("could not compress request: %v", err)
+		}
+		headers = append(headers, [2]string{"Content-Encoding", opts.Compression})
+	}
+	// sign what is sent, so receivers can verify the body before decompressing
+	// it
+	if endpoint.Signing.Enabled() {
+		signature, err := signatureHeaders(endpoint.Signing, body, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("could not sign request: %v", err)
+		}
+		headers = append(headers, signature...)
+	}
+	var tokens *tokenSource
+	if endpoint.OAuth.Enabled() {
+		tokens = tokenSourceFor(endpoint.Name, endpoint.OAuth, opts)
+	}
+
+	resp, err := performRequest(ctx, client, opts.Method, target, headers, body, tokens)
+	if err == nil && tokens != nil && resp.StatusCode == http.StatusUnauthorized {
+		// the token may have been revoked before it expired, retry once with a
+		// fresh one
+		io.Copy(io.Discard, io.LimitReader(resp.Body, opts.MaxResponseBytes))
+		resp.Body.Close()
+		tokens.invalidate()
+		resp, err = performRequest(ctx, client, opts.Method, target, headers, body, tokens)
+	}
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
-	return resp.StatusCode, nil
+	r, err := readResponse(resp, opts)
+	if err != nil {
+		return nil, &endpointError{err}
+	}
+	return r, nil
 }
 
-func performPOSTRequest(url string, headers [][2]string, body *bytes.Buffer) (*http.Response, error) {
-	client := &http.Client{}
-
-	req, err := http.NewRequest("POST", url, body)
+func performRequest(ctx context.Context, client *http.Client, method string, url string, headers [][2]string, body []byte, tokens *tokenSource) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("Unable to create HTTP request: %v", err)
 	}
@@ -67,5 +287,17 @@ func performPOSTRequest(url string, headers [][2]string, body *bytes.Buffer) (*h
 		req.Header.Set(pair[0], pair[1])
 	}
 
-	return client.Do(req)
+	if tokens != nil {
+		token, err := tokens.token()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get OAuth token: %v", err)
+		}
+		token.SetAuthHeader(req)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &endpointError{err}
+	}
+	return resp, nil
 }
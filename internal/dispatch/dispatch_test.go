@@ -1,6 +1,7 @@
 package dispatch
 
 import (
+	"github.com/rktjmp/smtp-pigeon/internal/config"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"net/http"
@@ -23,7 +24,7 @@ func makeTemplateData() *TemplateData {
 	}
 }
 
-func TestPOSTNoHeaders(t *testing.T) {
+func TestRequestNoHeaders(t *testing.T) {
 	assert := assert.New(t)
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -38,18 +39,18 @@ func TestPOSTNoHeaders(t *testing.T) {
 	defer server.Close()
 
 	ep := &Endpoint{
-		URL:     server.URL,
-		Headers: [][2]string{},
+		URL:     template.Must(template.New("url").Parse(server.URL)),
+		Headers: []config.HeaderPair{},
 	}
 	data := makeTemplateData()
 
 	tmpl, err := template.New("test").Parse("{{.ID}}")
 	assert.Nil(err)
-	status, err := POST(ep, tmpl, data)
+	status, err := Request(ep, tmpl, data)
 	assert.NotNil(status)
 }
 
-func TestPOSTCustomHeaders(t *testing.T) {
+func TestRequestCustomHeaders(t *testing.T) {
 	assert := assert.New(t)
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -60,10 +61,10 @@ func TestPOSTCustomHeaders(t *testing.T) {
 	defer server.Close()
 
 	ep := &Endpoint{
-		URL: server.URL,
-		Headers: [][2]string{
-			[2]string{"Content-Type", "text/plain"},
-			[2]string{"NodeID", "my-node"},
+		URL: template.Must(template.New("url").Parse(server.URL)),
+		Headers: []config.HeaderPair{
+			{Key: "Content-Type", Value: template.Must(template.New("h").Parse("text/plain"))},
+			{Key: "NodeID", Value: template.Must(template.New("h").Parse("my-node"))},
 		},
 	}
 
@@ -71,11 +72,11 @@ func TestPOSTCustomHeaders(t *testing.T) {
 
 	tmpl, err := template.New("test").Parse("{{.ID}}")
 	assert.Nil(err)
-	status, err := POST(ep, tmpl, data)
+	status, err := Request(ep, tmpl, data)
 	assert.NotNil(status)
 }
 
-func TestPOSTServerError(t *testing.T) {
+func TestRequestServerError(t *testing.T) {
 	assert := assert.New(t)
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -83,30 +84,147 @@ func TestPOSTServerError(t *testing.T) {
 	server.Close()
 
 	ep := &Endpoint{
-		URL:     server.URL,
-		Headers: [][2]string{},
+		URL:     template.Must(template.New("url").Parse(server.URL)),
+		Headers: []config.HeaderPair{},
 	}
 	data := makeTemplateData()
 
 	tmpl, err := template.New("test").Parse("{{.ID}}")
 	assert.Nil(err)
-	status, err := POST(ep, tmpl, data)
+	status, err := Request(ep, tmpl, data)
 	assert.Equal(0, status)
 	assert.NotNil(err)
 }
 
-func TestPOSTTemplateExecuteError(t *testing.T) {
+func TestRequestTemplateExecuteError(t *testing.T) {
 	assert := assert.New(t)
 
 	ep := &Endpoint{
-		URL:     "anything",
-		Headers: [][2]string{},
+		URL:     template.Must(template.New("url").Parse("anything")),
+		Headers: []config.HeaderPair{},
 	}
 	data := makeTemplateData()
 
 	tmpl, err := template.New("test").Parse("{{.IDs}}")
 	assert.Nil(err)
-	status, err := POST(ep, tmpl, data)
+	status, err := Request(ep, tmpl, data)
 	assert.Equal(0, status)
 	assert.NotNil(err)
 }
+
+func makeEndpoint(url string, opts *config.HTTPOptions) *Endpoint {
+	return &Endpoint{
+		URL:     template.Must(template.New("url").Parse(url)),
+		Headers: []config.HeaderPair{},
+		HTTP:    opts,
+	}
+}
+
+func TestRequestMethod(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("PUT", r.Method)
+	}))
+	defer server.Close()
+
+	opts := config.DefaultHTTPOptions()
+	opts.Method = "PUT"
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	status, err := Request(makeEndpoint(server.URL, opts), tmpl, makeTemplateData())
+	assert.Nil(err)
+	assert.Equal(200, status)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	opts := config.DefaultHTTPOptions()
+	opts.Timeout = 50 * time.Millisecond
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	status, err := Request(makeEndpoint(server.URL, opts), tmpl, makeTemplateData())
+	assert.Equal(0, status)
+	assert.NotNil(err)
+}
+
+func TestRequestRedirectPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		}
+	}))
+	defer server.Close()
+
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+
+	opts := config.DefaultHTTPOptions()
+	status, err := Request(makeEndpoint(server.URL+"/moved", opts), tmpl, makeTemplateData())
+	assert.Nil(err)
+	assert.Equal(200, status, "follows redirects by default")
+
+	opts = config.DefaultHTTPOptions()
+	opts.MaxRedirects = 0
+	status, err = Request(makeEndpoint(server.URL+"/moved", opts), tmpl, makeTemplateData())
+	assert.Nil(err)
+	assert.Equal(307, status, "returns redirect when not following")
+}
+
+func TestClientIsShared(t *testing.T) {
+	assert := assert.New(t)
+
+	opts := config.DefaultHTTPOptions()
+	a, _ := clientFor("shared", opts, "")
+	b, _ := clientFor("shared", opts, "")
+	d, _ := clientFor("shared", opts, "/run/agent.sock")
+	e, _ := clientFor("other", opts, "")
+	assert.Same(a, b)
+	assert.NotSame(a, d)
+	assert.NotSame(a, e)
+
+	// reloaded options that are the same keep the client
+	b, _ = clientFor("shared", config.DefaultHTTPOptions(), "")
+	assert.Same(a, b)
+	changed := config.DefaultHTTPOptions()
+	changed.Timeout = time.Second
+	c, _ := clientFor("shared", changed, "")
+	assert.NotSame(a, c)
+}
+
+func TestRender(t *testing.T) {
+	assert := assert.New(t)
+
+	ep, err := config.NewEndpoint("e", "http://localhost/{{.Recipient.Local}}", []string{"X-Sender: {{.Sender}}"}, "", nil)
+	assert.Nil(err)
+	ep.HTTP = &config.HTTPOptions{Method: "PUT"}
+	data := makeTemplateData()
+	data.Recipient = NewAddress("you@host")
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+
+	r, err := Render(ep, tmpl, data)
+	assert.Nil(err)
+	assert.Equal(&Rendering{
+		Method:  "PUT",
+		URL:     "http://localhost/you",
+		Headers: [][2]string{{"X-Sender", "me@host"}},
+		Body:    []byte("constant-id"),
+	}, r)
+
+	// brokers are published to, without headers
+	ep.URL = template.Must(template.New("url").Parse("nats://localhost/alerts"))
+	r, err = Render(ep, tmpl, data)
+	assert.Nil(err)
+	assert.Equal("", r.Method)
+	assert.Nil(r.Headers)
+
+	_, err = Render(ep, template.Must(template.New("test").Parse("{{.Missing}}")), data)
+	assert.NotNil(err)
+}
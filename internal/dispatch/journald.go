@@ -0,0 +1,107 @@
+package dispatch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journaldSink writes one entry per email using the native journal protocol,
+// eg: journald:// or journald:///run/systemd/journal/socket?facility=cron
+// Entries too large for a datagram are passed as a file descriptor instead.
+type journaldSink struct {
+	sync.Mutex
+	path     string
+	conn     net.Conn
+	facility int
+	severity int
+	appName  string
+}
+
+func newJournaldSink(server *url.URL) (sink, error) {
+	s := &journaldSink{appName: "smtp-pigeon"}
+	var err error
+	s.facility, s.severity, err = parsePriority(server.Query())
+	if err != nil {
+		return nil, err
+	}
+	if v := server.Query().Get("app"); v != "" {
+		s.appName = v
+	}
+	s.path = server.Path
+	if s.path == "" {
+		s.path = "/run/systemd/journal/socket"
+	}
+	s.conn, err = net.DialTimeout("unixgram", s.path, publishTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *journaldSink) publish(endpoint *Endpoint, target *url.URL, body []byte, data *TemplateData) (string, error) {
+	severity := severityFor(endpoint.SeverityRules, data, s.severity)
+
+	var entry bytes.Buffer
+	journalField(&entry, "MESSAGE", string(body))
+	journalField(&entry, "PRIORITY", fmt.Sprint(severity))
+	journalField(&entry, "SYSLOG_FACILITY", fmt.Sprint(s.facility))
+	journalField(&entry, "SYSLOG_IDENTIFIER", s.appName)
+	journalField(&entry, "SMTP_PIGEON_ID", data.ID)
+	journalField(&entry, "SMTP_PIGEON_SENDER", data.Sender)
+	for _, recipient := range data.Recipients {
+		journalField(&entry, "SMTP_PIGEON_RECIPIENT", recipient)
+	}
+	journalField(&entry, "SMTP_PIGEON_SUBJECT", data.Subject)
+
+	s.Lock()
+	defer s.Unlock()
+	if err := s.send(entry.Bytes()); err != nil {
+		// journald may have restarted since our last message
+		s.conn.Close()
+		conn, err := net.DialTimeout("unixgram", s.path, publishTimeout)
+		if err != nil {
+			return "", fmt.Errorf("journald reconnect failed: %v", err)
+		}
+		s.conn = conn
+		if err := s.send(entry.Bytes()); err != nil {
+			return "", fmt.Errorf("journald write failed: %v", err)
+		}
+	}
+	return fmt.Sprintf("logged to journald as %v.%v", facilities[s.facility], config.SeverityName(severity)), nil
+}
+
+// send writes the entry as a datagram, or passes it as a file if it is too
+// large for one.
+func (s *journaldSink) send(entry []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(publishTimeout))
+	_, err := s.conn.Write(entry)
+	if tooLargeForDatagram(err) {
+		return s.sendFile(entry)
+	}
+	return err
+}
+
+func (s *journaldSink) close() {
+	s.Lock()
+	defer s.Unlock()
+	s.conn.Close()
+}
+
+// journalField appends KEY=value, values containing newlines must use the
+// length prefixed binary form instead.
+func journalField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%v=%v\n", key, value)
+		return
+	}
+	buf.WriteString(key + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package dispatch
+
+import "fmt"
+
+// sendFile can't pass descriptors without unix sockets
+func (s *journaldSink) sendFile(entry []byte) error {
+	return fmt.Errorf("journald entry of %d bytes is too large to send", len(entry))
+}
+
+func tooLargeForDatagram(err error) bool {
+	return false
+}
@@ -0,0 +1,66 @@
+//go:build unix
+
+package dispatch
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// journalFileDirs are where entries too large for a datagram are written,
+// journald only accepts files from these.
+var journalFileDirs = []string{"/dev/shm", "/tmp"}
+
+// sendFile passes the entry to journald as the descriptor of a deleted file,
+// in an otherwise empty datagram, as sd_journal_send does when it can't use
+// a memfd.
+func (s *journaldSink) sendFile(entry []byte) error {
+	conn, ok := s.conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("journald entry of %d bytes is too large to send", len(entry))
+	}
+	f, err := journalFile()
+	if err != nil {
+		return fmt.Errorf("journald entry of %d bytes is too large to send: %v", len(entry), err)
+	}
+	defer f.Close()
+	if _, err := f.Write(entry); err != nil {
+		return err
+	}
+	// WriteMsgUnix refuses connected datagram sockets, so send on the socket
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	rights := syscall.UnixRights(int(f.Fd()))
+	var sendErr error
+	err = raw.Write(func(fd uintptr) bool {
+		sendErr = syscall.Sendmsg(int(fd), nil, rights, nil, 0)
+		return sendErr != syscall.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// journalFile creates a file that only its descriptor refers to
+func journalFile() (*os.File, error) {
+	var err error
+	for _, dir := range journalFileDirs {
+		var f *os.File
+		f, err = os.CreateTemp(dir, "smtp-pigeon-journal-")
+		if err == nil {
+			os.Remove(f.Name())
+			return f, nil
+		}
+	}
+	return nil, err
+}
+
+func tooLargeForDatagram(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS)
+}
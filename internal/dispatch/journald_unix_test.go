@@ -0,0 +1,87 @@
+//go:build unix
+
+package dispatch
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestDeliverJournaldLargeEntry(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	assert.Nil(err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// far larger than a datagram may be
+	body := strings.Repeat("hey guys running L8 2DAY\n", 100000)
+	ep := &Endpoint{Name: "journald-large", URL: template.Must(template.New("url").Parse("journald://" + path))}
+	data := makeTemplateData()
+	data.Body = body
+	_, _, err = Deliver(ep, template.Must(template.New("test").Parse("{{.Body}}")), data)
+	assert.Nil(err)
+
+	buf := make([]byte, 2048)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	assert.Nil(err)
+	assert.Equal(0, n, "the datagram only carries the descriptor")
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if !assert.Nil(err) || !assert.Equal(1, len(messages)) {
+		return
+	}
+	fds, err := syscall.ParseUnixRights(&messages[0])
+	if !assert.Nil(err) || !assert.Equal(1, len(fds)) {
+		return
+	}
+	f := os.NewFile(uintptr(fds[0]), "entry")
+	defer f.Close()
+	f.Seek(0, io.SeekStart)
+	entry, err := io.ReadAll(f)
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(string(entry), "MESSAGE\n"))
+	assert.Contains(string(entry), body)
+}
+
+func TestDeliverJournaldRedials(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	listen := func() *net.UnixConn {
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+		assert.Nil(err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	ep := &Endpoint{Name: "journald-redial", URL: template.Must(template.New("url").Parse("journald://" + path))}
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	buf := make([]byte, 2048)
+
+	conn := listen()
+	_, _, err := Deliver(ep, tmpl, makeTemplateData())
+	assert.Nil(err)
+	_, err = conn.Read(buf)
+	assert.Nil(err)
+
+	// journald restarts, its socket is a new one
+	conn.Close()
+	os.Remove(path)
+	conn = listen()
+	defer conn.Close()
+	_, _, err = Deliver(ep, tmpl, makeTemplateData())
+	assert.Nil(err)
+	n, err := conn.Read(buf)
+	assert.Nil(err)
+	assert.Contains(string(buf[:n]), "MESSAGE=constant-id\n")
+}
@@ -0,0 +1,83 @@
+package dispatch
+
+import (
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"net/url"
+	"strconv"
+)
+
+// mqttSink publishes to an MQTT topic given as the URL path. QoS (0, 1 or 2)
+// and retain may be set as query parameters, eg:
+// mqtt://localhost:1883/mail/{{.Recipient.Local}}?qos=1&retain=false
+type mqttSink struct {
+	client mqtt.Client
+	qos    byte
+	retain bool
+}
+
+func newMQTTSink(server *url.URL) (sink, error) {
+	query := server.Query()
+	qos := 0
+	if v := query.Get("qos"); v != "" {
+		var err error
+		qos, err = strconv.Atoi(v)
+		if err != nil || qos < 0 || qos > 2 {
+			return nil, fmt.Errorf("MQTT qos must be 0, 1 or 2, got %q", v)
+		}
+	}
+	retain := false
+	if v := query.Get("retain"); v != "" {
+		var err error
+		retain, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("MQTT retain must be true or false, got %q", v)
+		}
+	}
+
+	scheme := "tcp"
+	if server.Scheme == "mqtts" {
+		scheme = "ssl"
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(fmt.Sprintf("%v://%v", scheme, server.Host)).
+		SetClientID("smtp-pigeon-" + uuid.New().String()[:8]).
+		SetConnectTimeout(publishTimeout).
+		SetAutoReconnect(true)
+	if server.User != nil {
+		opts.SetUsername(server.User.Username())
+		password, _ := server.User.Password()
+		opts.SetPassword(password)
+	}
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(publishTimeout) {
+		return nil, fmt.Errorf("timed out connecting")
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	return &mqttSink{client: client, qos: byte(qos), retain: retain}, nil
+}
+
+func (s *mqttSink) publish(endpoint *Endpoint, target *url.URL, body []byte, data *TemplateData) (string, error) {
+	topic, err := targetName(target)
+	if err != nil {
+		return "", err
+	}
+	token := s.client.Publish(topic, s.qos, s.retain, body)
+	if !token.WaitTimeout(publishTimeout) {
+		return "", fmt.Errorf("MQTT publish timed out")
+	}
+	if err := token.Error(); err != nil {
+		return "", fmt.Errorf("MQTT publish failed: %v", err)
+	}
+	return fmt.Sprintf("published to MQTT topic %q (qos %d)", topic, s.qos), nil
+}
+
+func (s *mqttSink) close() {
+	// give in flight messages a moment to be sent
+	s.client.Disconnect(250)
+}
@@ -0,0 +1,105 @@
+package dispatch
+
+import (
+	"context"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// tokenSource caches client credentials tokens, refreshing them when they are
+// close to expiry or have been rejected by the endpoint.
+type tokenSource struct {
+	sync.Mutex
+	opts config.OAuthOptions
+	// http are the endpoint's options, only the proxy and timeouts apply to
+	// the token URL
+	http   config.HTTPOptions
+	source oauth2.TokenSource
+}
+
+// tokenSources are kept per endpoint, so reloads keep the token while the
+// options are unchanged.
+var tokenSources = struct {
+	sync.Mutex
+	shared map[string]*tokenSource
+}{shared: map[string]*tokenSource{}}
+
+// tokenSourceFor returns the endpoint's shared token source, tokens are
+// fetched using the proxy and timeouts of the endpoint's HTTP options. When
+// the options have changed the cached token is dropped.
+func tokenSourceFor(endpoint string, opts *config.OAuthOptions, httpOpts *config.HTTPOptions) *tokenSource {
+	tokenSources.Lock()
+	defer tokenSources.Unlock()
+	ts, ok := tokenSources.shared[endpoint]
+	if ok && reflect.DeepEqual(ts.opts, *opts) && reflect.DeepEqual(ts.http, *httpOpts) {
+		return ts
+	}
+	ts = &tokenSource{opts: *opts, http: *httpOpts}
+	tokenSources.shared[endpoint] = ts
+	return ts
+}
+
+// token returns a cached token, or fetches a new one.
+func (ts *tokenSource) token() (*oauth2.Token, error) {
+	ts.Lock()
+	defer ts.Unlock()
+	if ts.source == nil {
+		secret, err := ts.opts.ClientSecret()
+		if err != nil {
+			return nil, err
+		}
+		httpClient, err := tokenClient(&ts.http)
+		if err != nil {
+			return nil, err
+		}
+		cc := &clientcredentials.Config{
+			ClientID:     ts.opts.ClientID,
+			ClientSecret: secret,
+			TokenURL:     ts.opts.TokenURL,
+			Scopes:       ts.opts.Scopes,
+		}
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+		// clientcredentials.Config.Token always fetches, the reuse wrapper
+		// decides when that is needed.
+		fetch := tokenFunc(func() (*oauth2.Token, error) { return cc.Token(ctx) })
+		ts.source = oauth2.ReuseTokenSourceWithExpiry(nil, fetch, ts.opts.RefreshBefore)
+	}
+	return ts.source.Token()
+}
+
+// tokenClient returns a client for the token URL. The identity provider is
+// not the endpoint, so the endpoint's CA, client certificate, pins and unix
+// socket are not used, only its proxy and timeouts.
+func tokenClient(opts *config.HTTPOptions) (*http.Client, error) {
+	proxy, err := opts.ProxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   opts.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Transport: transport, Timeout: opts.Timeout}, nil
+}
+
+// invalidate drops the cached token so the next request fetches a new one.
+func (ts *tokenSource) invalidate() {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.source = nil
+}
+
+type tokenFunc func() (*oauth2.Token, error)
+
+func (f tokenFunc) Token() (*oauth2.Token, error) {
+	return f()
+}
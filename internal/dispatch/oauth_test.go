@@ -0,0 +1,180 @@
+package dispatch
+
+import (
+	"fmt"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// tokenServer issues "token-1", "token-2", ... valid for expiresIn seconds
+func tokenServer(t *testing.T, expiresIn int) (*httptest.Server, *int32) {
+	var issued int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "client_credentials" {
+			w.WriteHeader(400)
+			return
+		}
+		n := atomic.AddInt32(&issued, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":%d}`, n, expiresIn)
+	}))
+	t.Cleanup(server.Close)
+	return server, &issued
+}
+
+func oauthRequest(opts *config.OAuthOptions, url string) (int, error) {
+	ep := makeEndpoint(url, nil)
+	ep.OAuth = opts
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	return Request(ep, tmpl, makeTemplateData())
+}
+
+func TestRequestOAuthTokenIsCached(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("PIGEON_TEST_CLIENT_SECRET", "shh")
+	tokens, issued := tokenServer(t, 3600)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("Bearer token-1", r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+
+	opts := &config.OAuthOptions{TokenURL: tokens.URL, ClientID: "pigeon", ClientSecretEnv: "PIGEON_TEST_CLIENT_SECRET", RefreshBefore: time.Minute}
+	for i := 0; i < 3; i++ {
+		status, err := oauthRequest(opts, server.URL)
+		assert.Nil(err)
+		assert.Equal(200, status)
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(issued))
+}
+
+func TestRequestOAuthRefreshesBeforeExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("PIGEON_TEST_CLIENT_SECRET", "shh")
+	// tokens expire within the refresh window so are never reused
+	tokens, issued := tokenServer(t, 30)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	opts := &config.OAuthOptions{TokenURL: tokens.URL, ClientID: "pigeon", ClientSecretEnv: "PIGEON_TEST_CLIENT_SECRET", RefreshBefore: time.Minute}
+	oauthRequest(opts, server.URL)
+	oauthRequest(opts, server.URL)
+	assert.Equal(int32(2), atomic.LoadInt32(issued))
+}
+
+func TestRequestOAuthRetriesOnUnauthorized(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("PIGEON_TEST_CLIENT_SECRET", "shh")
+	tokens, issued := tokenServer(t, 3600)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first token has been revoked
+		if r.Header.Get("Authorization") == "Bearer token-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	opts := &config.OAuthOptions{TokenURL: tokens.URL, ClientID: "pigeon", ClientSecretEnv: "PIGEON_TEST_CLIENT_SECRET", RefreshBefore: time.Minute}
+	status, err := oauthRequest(opts, server.URL)
+	assert.Nil(err)
+	assert.Equal(200, status)
+	assert.Equal(int32(2), atomic.LoadInt32(issued))
+}
+
+func TestRequestOAuthTokenError(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("PIGEON_TEST_CLIENT_SECRET", "shh")
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer tokens.Close()
+
+	opts := &config.OAuthOptions{TokenURL: tokens.URL, ClientID: "pigeon", ClientSecretEnv: "PIGEON_TEST_CLIENT_SECRET"}
+	status, err := oauthRequest(opts, "http://localhost")
+	assert.Equal(0, status)
+	assert.NotNil(err)
+}
+
+func TestRequestOAuthTokenURLIgnoresEndpointTLSAndSocket(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("PIGEON_TEST_CLIENT_SECRET", "shh")
+	tokens, issued := tokenServer(t, 3600)
+	oauth := &config.OAuthOptions{TokenURL: tokens.URL, ClientID: "pigeon", ClientSecretEnv: "PIGEON_TEST_CLIENT_SECRET", RefreshBefore: time.Minute}
+
+	// the endpoint's CA, client certificate and pin don't apply to the
+	// identity provider
+	ca := issue(t, "ca", nil, true)
+	serverCert := issue(t, "server", ca, false)
+	server := mutualTLSServer(t, ca, serverCert)
+	client := issue(t, "client", ca, false)
+	opts := config.DefaultHTTPOptions()
+	opts.CAFile = ca.certFile
+	opts.CertFile = client.certFile
+	opts.KeyFile = client.keyFile
+	opts.PinnedSPKI = []string{serverCert.pin()}
+	ep := makeEndpoint(server.URL, nil)
+	ep.HTTP = opts
+	ep.OAuth = oauth
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	status, err := Request(ep, tmpl, makeTemplateData())
+	assert.Nil(err)
+	assert.Equal(200, status)
+	assert.Equal(int32(1), atomic.LoadInt32(issued))
+
+	// nor is the token fetched through the endpoint's unix socket
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.Nil(err)
+	agent := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/hooks/mail", r.URL.Path)
+		assert.Equal("Bearer token-2", r.Header.Get("Authorization"))
+	}))
+	agent.Listener = listener
+	agent.Start()
+	defer agent.Close()
+	ep = makeEndpoint("unix://"+socket+":/hooks/mail", nil)
+	ep.OAuth = &config.OAuthOptions{TokenURL: tokens.URL, ClientID: "pigeon", ClientSecretEnv: "PIGEON_TEST_CLIENT_SECRET", RefreshBefore: time.Minute}
+	status, err = Request(ep, tmpl, makeTemplateData())
+	assert.Nil(err)
+	assert.Equal(200, status)
+	assert.Equal(int32(2), atomic.LoadInt32(issued))
+}
+
+func TestRequestOAuthTokenSurvivesReload(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("PIGEON_TEST_CLIENT_SECRET", "shh")
+	tokens, issued := tokenServer(t, 3600)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	request := func(clientID string) {
+		// every reload builds new options
+		ep := makeEndpoint(server.URL, config.DefaultHTTPOptions())
+		ep.Name = "reloaded-oauth"
+		ep.OAuth = &config.OAuthOptions{TokenURL: tokens.URL, ClientID: clientID, ClientSecretEnv: "PIGEON_TEST_CLIENT_SECRET", RefreshBefore: time.Minute}
+		_, err := Request(ep, tmpl, makeTemplateData())
+		assert.Nil(err)
+	}
+	request("pigeon")
+	request("pigeon")
+	assert.Equal(int32(1), atomic.LoadInt32(issued))
+
+	// other credentials need another token
+	request("other")
+	assert.Equal(int32(2), atomic.LoadInt32(issued))
+}
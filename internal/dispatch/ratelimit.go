@@ -0,0 +1,99 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"golang.org/x/time/rate"
+	"net/url"
+	"sync"
+)
+
+// ErrRateLimited is returned without attempting delivery when too many
+// deliveries to an endpoint are already waiting on its rate limit.
+var ErrRateLimited = errors.New("rate limit queue full")
+
+// deliveries waiting on a rate limit, per endpoint and server
+var rateLimitQueued = expvar.NewMap("rate_limit_queued")
+
+// limiter is a token bucket with a bounded number of waiters
+type limiter struct {
+	name   string
+	bucket *rate.Limiter
+
+	sync.Mutex
+	maxQueue int
+	queued   int
+}
+
+// limiters are kept per endpoint and server rather than per options, so
+// reloads don't refill the bucket.
+type limiterKey struct {
+	endpoint string
+	server   string
+}
+
+var limiters = struct {
+	sync.Mutex
+	shared map[limiterKey]*limiter
+}{shared: map[limiterKey]*limiter{}}
+
+// limiterFor returns the endpoint's limiter for the target's server, or nil if
+// rate limiting is disabled. Changed options apply to an existing limiter
+// without refilling it.
+func limiterFor(endpoint string, opts *config.RateLimitOptions, target *url.URL) *limiter {
+	if !opts.Enabled() {
+		return nil
+	}
+	key := limiterKey{endpoint: endpoint, server: serverName(target)}
+
+	limiters.Lock()
+	defer limiters.Unlock()
+	if l, ok := limiters.shared[key]; ok {
+		if l.bucket.Limit() != rate.Limit(opts.PerSecond) {
+			l.bucket.SetLimit(rate.Limit(opts.PerSecond))
+		}
+		if l.bucket.Burst() != opts.Burst {
+			l.bucket.SetBurst(opts.Burst)
+		}
+		l.Lock()
+		l.maxQueue = opts.MaxQueue
+		l.Unlock()
+		return l
+	}
+	l := &limiter{
+		name:     metricName(endpoint, key.server),
+		bucket:   rate.NewLimiter(rate.Limit(opts.PerSecond), opts.Burst),
+		maxQueue: opts.MaxQueue,
+	}
+	limiters.shared[key] = l
+	return l
+}
+
+// wait blocks until a delivery may be made or ctx is done, or returns
+// ErrRateLimited if the queue is full.
+func (l *limiter) wait(ctx context.Context) error {
+	l.Lock()
+	// a free token doesn't need a place in the queue, unless deliveries are
+	// already waiting, which go first
+	if l.queued == 0 && l.bucket.Allow() {
+		l.Unlock()
+		return nil
+	}
+	if l.queued >= l.maxQueue {
+		l.Unlock()
+		return ErrRateLimited
+	}
+	l.queued++
+	l.Unlock()
+	rateLimitQueued.Add(l.name, 1)
+
+	err := l.bucket.Wait(ctx)
+
+	l.Lock()
+	l.queued--
+	l.Unlock()
+	rateLimitQueued.Add(l.name, -1)
+	return err
+}
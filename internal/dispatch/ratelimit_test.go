@@ -0,0 +1,93 @@
+package dispatch
+
+import (
+	"context"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestDeliverRateLimitQueues(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	ep := makeEndpoint(server.URL, nil)
+	ep.RateLimit = &config.RateLimitOptions{PerSecond: 20, Burst: 1, MaxQueue: 10, Overflow: "tempfail"}
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := Deliver(ep, tmpl, makeTemplateData())
+			assert.Nil(err)
+		}()
+	}
+	wg.Wait()
+	// one immediately, two more at 20/s
+	assert.GreaterOrEqual(time.Since(start), 90*time.Millisecond)
+}
+
+func TestDeliverRateLimitQueueFull(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	ep := makeEndpoint(server.URL, nil)
+	ep.RateLimit = &config.RateLimitOptions{PerSecond: 0.1, Burst: 1, MaxQueue: 0, Overflow: "tempfail"}
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+
+	_, _, err := Deliver(ep, tmpl, makeTemplateData())
+	assert.Nil(err)
+	_, _, err = Deliver(ep, tmpl, makeTemplateData())
+	assert.ErrorIs(err, ErrRateLimited)
+}
+
+func TestRateLimitSurvivesReload(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	ep := makeEndpoint(server.URL, nil)
+	ep.Name = "reloaded-limit"
+	ep.RateLimit = &config.RateLimitOptions{PerSecond: 0.1, Burst: 1, MaxQueue: 0, Overflow: "tempfail"}
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	_, _, err := Deliver(ep, tmpl, makeTemplateData())
+	assert.Nil(err)
+
+	// a reload builds new options, the bucket isn't refilled
+	reloaded := *ep
+	reloaded.RateLimit = &config.RateLimitOptions{PerSecond: 0.1, Burst: 1, MaxQueue: 0, Overflow: "tempfail"}
+	_, _, err = Deliver(&reloaded, tmpl, makeTemplateData())
+	assert.ErrorIs(err, ErrRateLimited)
+}
+
+func TestRateLimitWaitersGoFirst(t *testing.T) {
+	assert := assert.New(t)
+
+	target, _ := url.Parse("http://first-in-line")
+	l := limiterFor("first-in-line", &config.RateLimitOptions{PerSecond: 1, Burst: 1, MaxQueue: 1, Overflow: "tempfail"}, target)
+	assert.Nil(l.wait(context.Background()), "a free token is used straight away")
+
+	// with a delivery waiting a new one queues behind it, even once a token is
+	// free
+	l.bucket.SetLimit(rate.Inf)
+	l.Lock()
+	l.queued = 1
+	l.Unlock()
+	assert.ErrorIs(l.wait(context.Background()), ErrRateLimited)
+	assert.Equal("first-in-line/http://first-in-line", l.name, "metrics are per endpoint and server")
+}
@@ -0,0 +1,82 @@
+package dispatch
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"net/url"
+	"strconv"
+)
+
+// redisSink appends to a Redis stream given as the URL path. The database
+// and an approximate stream length cap may be set as query parameters, eg:
+// redis://:password@localhost:6379/mail:{{.Recipient.Local}}?db=0&maxlen=1000
+type redisSink struct {
+	client *redis.Client
+	maxLen int64
+}
+
+func newRedisSink(server *url.URL) (sink, error) {
+	query := server.Query()
+	opts := &redis.Options{
+		Addr:         server.Host,
+		DialTimeout:  publishTimeout,
+		ReadTimeout:  publishTimeout,
+		WriteTimeout: publishTimeout,
+	}
+	if server.User != nil {
+		opts.Username = server.User.Username()
+		opts.Password, _ = server.User.Password()
+	}
+	if server.Scheme == "rediss" {
+		opts.TLSConfig = &tls.Config{ServerName: server.Hostname()}
+	}
+	if v := query.Get("db"); v != "" {
+		db, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("Redis db must be a number, got %q", v)
+		}
+		opts.DB = db
+	}
+	var maxLen int64
+	if v := query.Get("maxlen"); v != "" {
+		var err error
+		maxLen, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Redis maxlen must be a number, got %q", v)
+		}
+	}
+
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisSink{client: client, maxLen: maxLen}, nil
+}
+
+func (s *redisSink) publish(endpoint *Endpoint, target *url.URL, body []byte, data *TemplateData) (string, error) {
+	stream, err := targetName(target)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	id, err := s.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: s.maxLen,
+		Approx: s.maxLen > 0,
+		Values: map[string]interface{}{"payload": body},
+	}).Result()
+	if err != nil {
+		return "", fmt.Errorf("Redis XADD failed: %v", err)
+	}
+	return fmt.Sprintf("appended to Redis stream %q as %v", stream, id), nil
+}
+
+func (s *redisSink) close() {
+	s.client.Close()
+}
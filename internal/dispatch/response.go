@@ -0,0 +1,52 @@
+package dispatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// Response is an endpoint's reply, the body is truncated to MaxResponseBytes.
+// JSON is only set when response parsing is enabled and the body is complete,
+// valid JSON.
+type Response struct {
+	Status int
+	Header http.Header
+	Body   string
+	JSON   interface{}
+}
+
+// OK reports whether the endpoint accepted the request with a 2xx status
+func (r *Response) OK() bool {
+	return r.Status >= 200 && r.Status < 300
+}
+
+func (r *Response) String() string {
+	return fmt.Sprintf("%d %v %q", r.Status, r.Header, r.Body)
+}
+
+func readResponse(resp *http.Response, opts *config.HTTPOptions) (*Response, error) {
+	// reading (a bounded amount of) the body also lets the connection be reused
+	body, err := io.ReadAll(io.LimitReader(resp.Body, opts.MaxResponseBytes))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read response: %v", err)
+	}
+	r := &Response{
+		Status: resp.StatusCode,
+		Header: resp.Header,
+		Body:   string(body),
+	}
+	if opts.ParseResponseJSON {
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if mediaType == "application/json" || (len(mediaType) > 5 && mediaType[len(mediaType)-5:] == "+json") {
+			var parsed interface{}
+			if json.Unmarshal(body, &parsed) == nil {
+				r.JSON = parsed
+			}
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,65 @@
+package dispatch
+
+import (
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestDoCapturesResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Reason", "nope")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(strings.Repeat("invalid payload ", 10)))
+	}))
+	defer server.Close()
+
+	opts := config.DefaultHTTPOptions()
+	opts.MaxResponseBytes = 15
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	resp, err := Do(makeEndpoint(server.URL, opts), tmpl, makeTemplateData())
+	assert.Nil(err)
+	assert.False(resp.OK())
+	assert.Equal(400, resp.Status)
+	assert.Equal("nope", resp.Header.Get("X-Reason"))
+	assert.Equal("invalid payload", resp.Body, "body is truncated")
+	assert.Nil(resp.JSON)
+}
+
+func TestDoParsesJSONResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(`{"ok":true,"ts":"1503435956.000247"}`))
+	}))
+	defer server.Close()
+
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+
+	opts := config.DefaultHTTPOptions()
+	resp, err := Do(makeEndpoint(server.URL, opts), tmpl, makeTemplateData())
+	assert.Nil(err)
+	assert.Nil(resp.JSON, "not parsed unless enabled")
+
+	opts = config.DefaultHTTPOptions()
+	opts.ParseResponseJSON = true
+	resp, err = Do(makeEndpoint(server.URL, opts), tmpl, makeTemplateData())
+	assert.Nil(err)
+	assert.True(resp.OK())
+	assert.Equal(map[string]interface{}{"ok": true, "ts": "1503435956.000247"}, resp.JSON)
+
+	// responses are available to later templates
+	data := makeTemplateData()
+	data.Responses = []*Response{resp}
+	var out strings.Builder
+	tmpl = template.Must(template.New("test").Parse(`{{(index .Responses 0).JSON.ts}}`))
+	assert.Nil(tmpl.Execute(&out, data))
+	assert.Equal("1503435956.000247", out.String())
+}
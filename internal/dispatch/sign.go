@@ -0,0 +1,53 @@
+package dispatch
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"hash"
+	"strconv"
+	"time"
+)
+
+// signatureHeaders signs the body with the configured secret.
+//
+// The stripe style signs "timestamp.body" and sends "t=timestamp,v1=digest",
+// the github style signs the body alone and sends "sha256=digest". Both may
+// also send the timestamp in its own header.
+func signatureHeaders(opts *config.SigningOptions, body []byte, now time.Time) ([][2]string, error) {
+	secret, err := opts.Secret()
+	if err != nil {
+		return nil, err
+	}
+	newHash := sha256.New
+	if opts.Algorithm == "sha512" {
+		newHash = sha512.New
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	var value string
+	switch opts.Style {
+	case "stripe":
+		digest := sign(newHash, secret, []byte(timestamp+"."), body)
+		value = fmt.Sprintf("t=%v,v1=%v", timestamp, digest)
+	case "github":
+		value = opts.Algorithm + "=" + sign(newHash, secret, body)
+	}
+
+	headers := [][2]string{{opts.Header, value}}
+	if opts.TimestampHeader != "" {
+		headers = append(headers, [2]string{opts.TimestampHeader, timestamp})
+	}
+	return headers, nil
+}
+
+func sign(newHash func() hash.Hash, secret []byte, parts ...[]byte) string {
+	mac := hmac.New(newHash, secret)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,97 @@
+package dispatch
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func expectedHMAC(secret, message string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestSignatureHeadersStripe(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("PIGEON_TEST_SECRET", "shh")
+	opts := &config.SigningOptions{Style: "stripe", Algorithm: "sha256", SecretEnv: "PIGEON_TEST_SECRET", TimestampHeader: "X-Timestamp"}
+	assert.Nil(opts.Validate())
+
+	headers, err := signatureHeaders(opts, []byte("payload"), time.Unix(1700000000, 0))
+	assert.Nil(err)
+	assert.Equal([][2]string{
+		{"X-Signature", "t=1700000000,v1=" + expectedHMAC("shh", "1700000000.payload")},
+		{"X-Timestamp", "1700000000"},
+	}, headers)
+}
+
+func TestSignatureHeadersGitHub(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("PIGEON_TEST_SECRET", "shh")
+	opts := &config.SigningOptions{Style: "github", Algorithm: "sha256", SecretEnv: "PIGEON_TEST_SECRET"}
+	assert.Nil(opts.Validate())
+
+	headers, err := signatureHeaders(opts, []byte("payload"), time.Now())
+	assert.Nil(err)
+	assert.Equal([][2]string{
+		{"X-Hub-Signature-256", "sha256=" + expectedHMAC("shh", "payload")},
+	}, headers)
+}
+
+func TestRequestIsSigned(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("PIGEON_TEST_SECRET", "shh")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(strings.HasPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256="))
+	}))
+	defer server.Close()
+
+	opts := &config.SigningOptions{Style: "github", Algorithm: "sha256", SecretEnv: "PIGEON_TEST_SECRET"}
+	assert.Nil(opts.Validate())
+	ep := makeEndpoint(server.URL, nil)
+	ep.Signing = opts
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	status, err := Request(ep, tmpl, makeTemplateData())
+	assert.Nil(err)
+	assert.Equal(200, status)
+}
+
+func TestRequestSignsCompressedBody(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv("PIGEON_TEST_SECRET", "shh")
+	var signature, sent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("gzip", r.Header.Get("Content-Encoding"))
+		signature = r.Header.Get("X-Hub-Signature-256")
+		b, _ := io.ReadAll(r.Body)
+		sent = string(b)
+	}))
+	defer server.Close()
+
+	opts := config.DefaultHTTPOptions()
+	opts.Compression = "gzip"
+	opts.CompressAbove = 100
+	ep := makeEndpoint(server.URL, opts)
+	ep.Signing = &config.SigningOptions{Style: "github", Algorithm: "sha256", Header: "X-Hub-Signature-256", SecretEnv: "PIGEON_TEST_SECRET"}
+	data := makeTemplateData()
+	data.Body = strings.Repeat("hey guys running L8 2DAY\n", 100)
+	tmpl := template.Must(template.New("test").Parse("{{.Body}}"))
+	status, err := Request(ep, tmpl, data)
+	assert.Nil(err)
+	assert.Equal(200, status)
+	assert.Equal("sha256="+expectedHMAC("shh", sent), signature)
+}
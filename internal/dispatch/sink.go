@@ -0,0 +1,180 @@
+package dispatch
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// publishTimeout bounds how long a broker may take to acknowledge a message
+const publishTimeout = 10 * time.Second
+
+// sink publishes rendered payloads to a message broker or log. Sinks hold a
+// connection open and are shared by every message sent to the same endpoint.
+type sink interface {
+	publish(endpoint *Endpoint, target *url.URL, body []byte, data *TemplateData) (string, error)
+	close()
+}
+
+var sinkConstructors = map[string]func(server *url.URL) (sink, error){
+	"nats":        newNATSSink,
+	"mqtt":        newMQTTSink,
+	"mqtts":       newMQTTSink,
+	"redis":       newRedisSink,
+	"rediss":      newRedisSink,
+	"syslog+udp":  newSyslogSink,
+	"syslog+tcp":  newSyslogSink,
+	"syslog+tls":  newSyslogSink,
+	"syslog+unix": newSyslogSink,
+	"journald":    newJournaldSink,
+}
+
+// openSink is a sink and the server it is connected to. Once it is replaced
+// or a publish fails it is stale, and closed when the last message using it
+// is done with it.
+type openSink struct {
+	server string
+	sink   sink
+	mu     sync.Mutex
+	users  int
+	stale  bool
+	closed bool
+}
+
+// endpointSink is an endpoint's current sink. Its lock is held while
+// connecting, so a slow server only holds up its own endpoint's messages.
+type endpointSink struct {
+	sync.Mutex
+	open *openSink
+}
+
+// sinks are kept per endpoint name, not per rendered URL, so templated URLs
+// can't open a connection per message.
+var sinks = struct {
+	sync.Mutex
+	endpoints map[string]*endpointSink
+}{endpoints: map[string]*endpointSink{}}
+
+func isBrokerScheme(scheme string) bool {
+	_, ok := sinkConstructors[scheme]
+	return ok
+}
+
+// acquireSink returns the endpoint's open sink for the target's server,
+// connecting if this is the first message sent there or the sink is stale. A
+// sink connected to another server is replaced. Release it once the message
+// is published.
+func acquireSink(endpoint string, target *url.URL) (*openSink, error) {
+	server := &url.URL{
+		Scheme:   target.Scheme,
+		User:     target.User,
+		Host:     target.Host,
+		RawQuery: target.RawQuery,
+	}
+	// unix socket sinks have no host, the socket path is the server
+	if target.Host == "" {
+		server.Path = target.Path
+	}
+	key := server.String()
+
+	sinks.Lock()
+	e, ok := sinks.endpoints[endpoint]
+	if !ok {
+		e = &endpointSink{}
+		sinks.endpoints[endpoint] = e
+	}
+	sinks.Unlock()
+
+	e.Lock()
+	defer e.Unlock()
+	if e.open != nil && e.open.server == key && e.open.use() {
+		return e.open, nil
+	}
+	if e.open != nil {
+		e.open.retire()
+		e.open = nil
+	}
+	s, err := sinkConstructors[target.Scheme](server)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %v: %v", target.Redacted(), err)
+	}
+	e.open = &openSink{server: key, sink: s, users: 1}
+	return e.open, nil
+}
+
+// use adds a user of the sink, unless it is stale
+func (o *openSink) use() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stale {
+		return false
+	}
+	o.users++
+	return true
+}
+
+// release is called when a user is done with the sink, failed marks it stale
+// so the next message connects again.
+func (o *openSink) release(failed bool) {
+	o.mu.Lock()
+	o.users--
+	o.stale = o.stale || failed
+	unused := o.unused()
+	o.mu.Unlock()
+	if unused {
+		o.sink.close()
+	}
+}
+
+// retire marks a sink that was replaced stale
+func (o *openSink) retire() {
+	o.mu.Lock()
+	o.stale = true
+	unused := o.unused()
+	o.mu.Unlock()
+	if unused {
+		o.sink.close()
+	}
+}
+
+// unused reports, once, that the sink is stale and nobody is using it so it
+// should be closed. o.mu must be held.
+func (o *openSink) unused() bool {
+	if !o.stale || o.users > 0 || o.closed {
+		return false
+	}
+	o.closed = true
+	return true
+}
+
+// targetName extracts the subject, topic or stream from the URL path.
+func targetName(target *url.URL) (string, error) {
+	name := strings.TrimPrefix(target.Path, "/")
+	if name == "" {
+		return "", fmt.Errorf("%v URL must include a path naming where to publish", target.Scheme)
+	}
+	return name, nil
+}
+
+// serverName identifies the server a target URL is delivered to, for keeping
+// state per endpoint.
+func serverName(target *url.URL) string {
+	server := target.Scheme + "://" + target.Host
+	if target.Host == "" {
+		// unix sockets, the socket path is the server
+		socket, _, _ := strings.Cut(target.Path, ":")
+		server += socket
+	}
+	return server
+}
+
+// metricName names an endpoint's state for a server in expvar metrics, the
+// same server may be used by more than one endpoint.
+func metricName(endpoint string, server string) string {
+	if endpoint == "" {
+		return server
+	}
+	return endpoint + "/" + server
+}
@@ -0,0 +1,310 @@
+package dispatch
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+type published struct {
+	target  string
+	payload string
+}
+
+// fakeNATS speaks just enough of the NATS protocol to accept PUBs
+func fakeNATS(t *testing.T) (string, chan published) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	out := make(chan published, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, `INFO {"server_id":"fake","version":"2.9.0","max_payload":1048576,"proto":1}`+"\r\n")
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) == 0:
+			case fields[0] == "PING":
+				fmt.Fprint(conn, "PONG\r\n")
+			case fields[0] == "PUB":
+				size, _ := strconv.Atoi(fields[len(fields)-1])
+				payload := make([]byte, size+2)
+				io.ReadFull(r, payload)
+				out <- published{fields[1], string(payload[:size])}
+			}
+		}
+	}()
+	return listener.Addr().String(), out
+}
+
+// fakeMQTT speaks just enough MQTT 3.1.1 to accept QoS 0 and 1 PUBLISHes
+func fakeMQTT(t *testing.T) (string, chan published) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	out := make(chan published, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			header, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			length, multiplier := 0, 1
+			for {
+				b, err := r.ReadByte()
+				if err != nil {
+					return
+				}
+				length += int(b&127) * multiplier
+				multiplier *= 128
+				if b&128 == 0 {
+					break
+				}
+			}
+			packet := make([]byte, length)
+			io.ReadFull(r, packet)
+			switch header >> 4 {
+			case 1: // CONNECT
+				conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+			case 3: // PUBLISH
+				topicLen := int(packet[0])<<8 | int(packet[1])
+				topic := string(packet[2 : 2+topicLen])
+				rest := packet[2+topicLen:]
+				if qos := (header >> 1) & 3; qos > 0 {
+					conn.Write([]byte{0x40, 0x02, rest[0], rest[1]})
+					rest = rest[2:]
+				}
+				out <- published{topic, string(rest)}
+			case 12: // PINGREQ
+				conn.Write([]byte{0xd0, 0x00})
+			case 14: // DISCONNECT
+				return
+			}
+		}
+	}()
+	return listener.Addr().String(), out
+}
+
+func deliverTo(t *testing.T, url string) (string, error) {
+	ep := &Endpoint{
+		URL:     template.Must(template.New("url").Parse(url)),
+		Headers: []config.HeaderPair{},
+	}
+	data := makeTemplateData()
+	data.Recipient = NewAddress("you@host")
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	status, _, err := Deliver(ep, tmpl, data)
+	return status, err
+}
+
+func TestNewAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	addr := NewAddress("some.one@sub.host")
+	assert.Equal("some.one@sub.host", addr.Address)
+	assert.Equal("some.one", addr.Local)
+	assert.Equal("sub.host", addr.Domain)
+
+	addr = NewAddress("root")
+	assert.Equal("root", addr.Local)
+	assert.Equal("", addr.Domain)
+}
+
+func TestDeliverNATS(t *testing.T) {
+	assert := assert.New(t)
+
+	addr, out := fakeNATS(t)
+	status, err := deliverTo(t, "nats://"+addr+"/mail.{{.Recipient.Local}}")
+	assert.Nil(err)
+	assert.Contains(status, "mail.you")
+	msg := <-out
+	assert.Equal("mail.you", msg.target)
+	assert.Equal("constant-id", msg.payload)
+}
+
+func TestDeliverMQTT(t *testing.T) {
+	assert := assert.New(t)
+
+	addr, out := fakeMQTT(t)
+	status, err := deliverTo(t, "mqtt://"+addr+"/mail/{{.Recipient.Local}}?qos=1")
+	assert.Nil(err)
+	assert.Contains(status, "qos 1")
+	msg := <-out
+	assert.Equal("mail/you", msg.target)
+	assert.Equal("constant-id", msg.payload)
+}
+
+func TestDeliverMQTTBadQoS(t *testing.T) {
+	assert := assert.New(t)
+
+	addr, _ := fakeMQTT(t)
+	_, err := deliverTo(t, "mqtt://"+addr+"/mail?qos=3")
+	assert.NotNil(err)
+}
+
+func TestDeliverRedis(t *testing.T) {
+	assert := assert.New(t)
+
+	server := miniredis.RunT(t)
+	_, err := deliverTo(t, "redis://"+server.Addr()+"/mail:{{.Recipient.Local}}")
+	assert.Nil(err)
+	entries, err := server.Stream("mail:you")
+	assert.Nil(err)
+	assert.Equal(1, len(entries))
+	assert.Equal([]string{"payload", "constant-id"}, entries[0].Values)
+}
+
+func TestDeliverBrokerWithoutTarget(t *testing.T) {
+	assert := assert.New(t)
+
+	server := miniredis.RunT(t)
+	_, err := deliverTo(t, "redis://"+server.Addr())
+	assert.NotNil(err)
+}
+
+func TestSinksAreKeptPerEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	first, second := miniredis.RunT(t), miniredis.RunT(t)
+	ep := &Endpoint{
+		Name:    "per-endpoint",
+		URL:     template.Must(template.New("url").Parse(`redis://{{index .Vars "server"}}/mail`)),
+		Headers: []config.HeaderPair{},
+	}
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	deliver := func(server string) error {
+		data := makeTemplateData()
+		data.Vars = map[string]string{"server": server}
+		_, _, err := Deliver(ep, tmpl, data)
+		return err
+	}
+	open := func() *openSink {
+		sinks.Lock()
+		e := sinks.endpoints["per-endpoint"]
+		sinks.Unlock()
+		e.Lock()
+		defer e.Unlock()
+		return e.open
+	}
+
+	assert.Nil(deliver(first.Addr()))
+	s := open().sink
+	assert.Nil(deliver(first.Addr()))
+	assert.Same(s, open().sink)
+
+	// a different server replaces the endpoint's sink
+	assert.Nil(deliver(second.Addr()))
+	assert.Equal("redis://"+second.Addr(), open().server)
+
+	// a failed publish closes it, the next message connects again
+	addr := second.Addr()
+	second.Close()
+	assert.NotNil(deliver(addr))
+	assert.True(open().closed)
+	assert.Nil(second.Restart())
+	assert.Nil(deliver(addr))
+	assert.False(open().stale)
+}
+
+type countingSink struct {
+	closes int
+}
+
+func (s *countingSink) publish(endpoint *Endpoint, target *url.URL, body []byte, data *TemplateData) (string, error) {
+	return "", nil
+}
+
+func (s *countingSink) close() {
+	s.closes++
+}
+
+func TestStaleSinkClosedByLastUser(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &countingSink{}
+	open := &openSink{sink: s, users: 1}
+	assert.True(open.use())
+
+	// a failure while another message is publishing leaves it open
+	open.release(true)
+	assert.Equal(0, s.closes)
+	assert.False(open.use(), "stale sinks aren't used again")
+	open.release(false)
+	assert.Equal(1, s.closes)
+	open.retire()
+	assert.Equal(1, s.closes)
+}
+
+func TestSlowSinkDoesNotBlockOtherEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	// accepts connections but never says hello
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	slow := &Endpoint{
+		Name:    "slow-sink",
+		URL:     template.Must(template.New("url").Parse("nats://" + listener.Addr().String() + "/mail")),
+		Headers: []config.HeaderPair{},
+	}
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	slowDone := make(chan error, 1)
+	go func() {
+		_, _, err := Deliver(slow, tmpl, makeTemplateData())
+		slowDone <- err
+	}()
+	conn := <-accepted
+
+	server := miniredis.RunT(t)
+	done := make(chan error, 1)
+	go func() {
+		_, err := deliverTo(t, "redis://"+server.Addr()+"/mail")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(err)
+	case <-time.After(2 * time.Second):
+		t.Error("delivery waited for another endpoint's connection")
+	}
+
+	conn.Close()
+	listener.Close()
+	assert.NotNil(<-slowDone)
+}
@@ -0,0 +1,182 @@
+package dispatch
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var facilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// sdID names our RFC 5424 structured-data element, 32473 is the enterprise
+// number reserved for documentation and examples.
+const sdID = "smtp-pigeon@32473"
+
+// syslogSink sends one RFC 5424 message per email, eg:
+// syslog+udp://logs:514?facility=mail&severity=info
+// syslog+tcp://logs:601, syslog+tls://logs:6514, syslog+unix:///dev/log
+type syslogSink struct {
+	sync.Mutex
+	network  string
+	address  string
+	tls      *tls.Config
+	conn     net.Conn
+	facility int
+	severity int
+	appName  string
+	hostname string
+}
+
+func newSyslogSink(server *url.URL) (sink, error) {
+	s := &syslogSink{appName: "smtp-pigeon"}
+	var err error
+	s.facility, s.severity, err = parsePriority(server.Query())
+	if err != nil {
+		return nil, err
+	}
+	if v := server.Query().Get("app"); v != "" {
+		s.appName = v
+	}
+	s.hostname, err = os.Hostname()
+	if err != nil {
+		s.hostname = "-"
+	}
+
+	switch server.Scheme {
+	case "syslog+udp":
+		s.network, s.address = "udp", server.Host
+	case "syslog+tcp":
+		s.network, s.address = "tcp", server.Host
+	case "syslog+tls":
+		s.network, s.address = "tcp", server.Host
+		s.tls = &tls.Config{ServerName: server.Hostname()}
+	case "syslog+unix":
+		s.network, s.address = "unixgram", server.Path
+		if s.address == "" {
+			s.address = "/dev/log"
+		}
+	}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func parsePriority(query url.Values) (int, int, error) {
+	facility, severity := 2, 6 // mail.info
+	if v := query.Get("facility"); v != "" {
+		facility = -1
+		for i, f := range facilities {
+			if f == v {
+				facility = i
+			}
+		}
+		if facility < 0 {
+			return 0, 0, fmt.Errorf("Unknown syslog facility %q, must be one of %v", v, facilities)
+		}
+	}
+	if v := query.Get("severity"); v != "" {
+		var err error
+		severity, err = config.ParseSeverity(v)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return facility, severity, nil
+}
+
+// severityFor returns the severity of the first rule matching the subject, or
+// the fallback if none match.
+func severityFor(rules []config.SeverityRule, data *TemplateData, fallback int) int {
+	subject := data.Header.Get("Subject")
+	for _, rule := range rules {
+		if rule.Pattern.MatchString(subject) {
+			return rule.Severity
+		}
+	}
+	return fallback
+}
+
+func (s *syslogSink) connect() error {
+	var conn net.Conn
+	var err error
+	if s.tls != nil {
+		dialer := &net.Dialer{Timeout: publishTimeout}
+		conn, err = tls.DialWithDialer(dialer, s.network, s.address, s.tls)
+	} else {
+		conn, err = net.DialTimeout(s.network, s.address, publishTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *syslogSink) publish(endpoint *Endpoint, target *url.URL, body []byte, data *TemplateData) (string, error) {
+	severity := severityFor(endpoint.SeverityRules, data, s.severity)
+	msg := s.format(severity, body, data)
+	// stream transports use octet counting framing (RFC 6587)
+	if s.network == "tcp" {
+		msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if err := s.write(msg); err != nil {
+		// the connection may have been dropped since our last message
+		s.conn.Close()
+		if err := s.connect(); err != nil {
+			return "", fmt.Errorf("syslog reconnect failed: %v", err)
+		}
+		if err := s.write(msg); err != nil {
+			return "", fmt.Errorf("syslog write failed: %v", err)
+		}
+	}
+	return fmt.Sprintf("logged to syslog as %v.%v", facilities[s.facility], config.SeverityName(severity)), nil
+}
+
+func (s *syslogSink) close() {
+	s.Lock()
+	defer s.Unlock()
+	s.conn.Close()
+}
+
+func (s *syslogSink) write(msg []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(publishTimeout))
+	_, err := s.conn.Write(msg)
+	return err
+}
+
+// format renders an RFC 5424 message, the body is sent as UTF-8 with a BOM.
+func (s *syslogSink) format(severity int, body []byte, data *TemplateData) []byte {
+	var sd strings.Builder
+	fmt.Fprintf(&sd, `[%v id="%v" sender="%v"`, sdID, sdEscape(data.ID), sdEscape(data.Sender))
+	for _, recipient := range data.Recipients {
+		fmt.Fprintf(&sd, ` recipient="%v"`, sdEscape(recipient))
+	}
+	sd.WriteString("]")
+
+	header := fmt.Sprintf("<%d>1 %v %v %v %d - %v \xef\xbb\xbf",
+		s.facility*8+severity,
+		time.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname,
+		s.appName,
+		os.Getpid(),
+		sd.String())
+	return append([]byte(header), body...)
+}
+
+func sdEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
@@ -0,0 +1,112 @@
+package dispatch
+
+import (
+	"bufio"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/mail"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func deliverWithRules(url string, rules []config.SeverityRule) (string, error) {
+	ep := &Endpoint{
+		URL:           template.Must(template.New("url").Parse(url)),
+		Headers:       []config.HeaderPair{},
+		SeverityRules: rules,
+	}
+	data := makeTemplateData()
+	data.Header = mail.Header{"Subject": []string{"backup FAILED"}}
+	data.Subject = "backup FAILED"
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	status, _, err := Deliver(ep, tmpl, data)
+	return status, err
+}
+
+func TestDeliverSyslogUDP(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer conn.Close()
+
+	rules := []config.SeverityRule{{Severity: 3, Pattern: regexp.MustCompile("FAILED")}}
+	status, err := deliverWithRules("syslog+udp://"+conn.LocalAddr().String()+"?facility=cron", rules)
+	assert.Nil(err)
+	assert.Equal("logged to syslog as cron.err", status)
+
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(buf)
+	assert.Nil(err)
+	msg := string(buf[:n])
+	// cron (9) * 8 + err (3)
+	assert.True(strings.HasPrefix(msg, "<75>1 "), msg)
+	assert.Contains(msg, ` smtp-pigeon `)
+	assert.Contains(msg, `[smtp-pigeon@32473 id="constant-id" sender="me@host" recipient="you@host" recipient="them@host"]`)
+	assert.True(strings.HasSuffix(msg, "\xef\xbb\xbfconstant-id"), msg)
+}
+
+func TestDeliverSyslogTCPFraming(t *testing.T) {
+	assert := assert.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		length, _ := r.ReadString(' ')
+		n, _ := strconv.Atoi(strings.TrimSpace(length))
+		msg := make([]byte, n)
+		r.Read(msg)
+		received <- string(msg)
+	}()
+
+	status, err := deliverWithRules("syslog+tcp://"+listener.Addr().String()+"?severity=notice", nil)
+	assert.Nil(err)
+	assert.Equal("logged to syslog as mail.notice", status)
+	// mail (2) * 8 + notice (5)
+	assert.True(strings.HasPrefix(<-received, "<21>1 "))
+}
+
+func TestDeliverSyslogBadFacility(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer conn.Close()
+	_, err = deliverWithRules("syslog+udp://"+conn.LocalAddr().String()+"?facility=nope", nil)
+	assert.NotNil(err)
+}
+
+func TestDeliverJournald(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	assert.Nil(err)
+	defer conn.Close()
+
+	status, err := deliverWithRules("journald://"+path, nil)
+	assert.Nil(err)
+	assert.Equal("logged to journald as mail.info", status)
+
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	assert.Nil(err)
+	entry := string(buf[:n])
+	assert.Contains(entry, "MESSAGE=constant-id\n")
+	assert.Contains(entry, "PRIORITY=6\n")
+	assert.Contains(entry, "SMTP_PIGEON_RECIPIENT=them@host\n")
+	assert.Contains(entry, "SMTP_PIGEON_SUBJECT=backup FAILED\n")
+}
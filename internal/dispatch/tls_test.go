@@ -0,0 +1,194 @@
+package dispatch
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+	"time"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// issue creates a certificate signed by parent, or self-signed if parent is nil
+func issue(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	dir := t.TempDir()
+	tc := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	os.WriteFile(tc.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(tc.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return tc
+}
+
+func (tc *testCert) pin() string {
+	digest := sha256.Sum256(tc.cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(digest[:])
+}
+
+func (tc *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{tc.cert.Raw}, PrivateKey: tc.key}
+}
+
+func mutualTLSServer(t *testing.T, ca, server *testCert) *httptest.Server {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate()},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func requestWith(opts *config.HTTPOptions, url string) (int, error) {
+	ep := &Endpoint{
+		URL:     template.Must(template.New("url").Parse(url)),
+		Headers: []config.HeaderPair{},
+		HTTP:    opts,
+	}
+	tmpl := template.Must(template.New("test").Parse("{{.ID}}"))
+	return Request(ep, tmpl, makeTemplateData())
+}
+
+func TestRequestMutualTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	ca := issue(t, "ca", nil, true)
+	server := mutualTLSServer(t, ca, issue(t, "server", ca, false))
+	client := issue(t, "client", ca, false)
+
+	opts := config.DefaultHTTPOptions()
+	opts.CAFile = ca.certFile
+	opts.CertFile = client.certFile
+	opts.KeyFile = client.keyFile
+	status, err := requestWith(opts, server.URL)
+	assert.Nil(err)
+	assert.Equal(200, status)
+
+	// without a client certificate the handshake fails
+	opts = config.DefaultHTTPOptions()
+	opts.CAFile = ca.certFile
+	_, err = requestWith(opts, server.URL)
+	assert.NotNil(err)
+
+	// without the CA the server is not trusted
+	opts = config.DefaultHTTPOptions()
+	opts.CertFile = client.certFile
+	opts.KeyFile = client.keyFile
+	_, err = requestWith(opts, server.URL)
+	assert.NotNil(err)
+}
+
+func TestRequestPinnedSPKI(t *testing.T) {
+	assert := assert.New(t)
+
+	ca := issue(t, "ca", nil, true)
+	serverCert := issue(t, "server", ca, false)
+	server := mutualTLSServer(t, ca, serverCert)
+	client := issue(t, "client", ca, false)
+
+	opts := config.DefaultHTTPOptions()
+	opts.CAFile = ca.certFile
+	opts.CertFile = client.certFile
+	opts.KeyFile = client.keyFile
+	opts.PinnedSPKI = []string{serverCert.pin()}
+	status, err := requestWith(opts, server.URL)
+	assert.Nil(err)
+	assert.Equal(200, status)
+
+	opts = config.DefaultHTTPOptions()
+	opts.CAFile = ca.certFile
+	opts.CertFile = client.certFile
+	opts.KeyFile = client.keyFile
+	opts.PinnedSPKI = []string{issue(t, "other", ca, false).pin()}
+	_, err = requestWith(opts, server.URL)
+	assert.NotNil(err)
+}
+
+func TestRequestPinnedSPKIIgnoresUnverifiedCertificates(t *testing.T) {
+	assert := assert.New(t)
+
+	ca := issue(t, "ca", nil, true)
+	serverCert := issue(t, "server", ca, false)
+	// the pinned certificate is public, the server sends it after its own
+	// without it being part of the verified chain
+	pinned := issue(t, "pinned", issue(t, "other-ca", nil, true), false)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{serverCert.cert.Raw, pinned.cert.Raw},
+		PrivateKey:  serverCert.key,
+	}}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	opts := config.DefaultHTTPOptions()
+	opts.CAFile = ca.certFile
+	opts.PinnedSPKI = []string{pinned.pin()}
+	_, err := requestWith(opts, ts.URL)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "pinned public key")
+	}
+
+	// pinning the CA of the verified chain works
+	opts = config.DefaultHTTPOptions()
+	opts.CAFile = ca.certFile
+	opts.PinnedSPKI = []string{ca.pin()}
+	status, err := requestWith(opts, ts.URL)
+	assert.Nil(err)
+	assert.Equal(200, status)
+}
@@ -0,0 +1,128 @@
+package queue
+
+import (
+	"context"
+	"expvar"
+	"github.com/rktjmp/smtp-pigeon/internal/spool"
+	"sync"
+)
+
+// messages waiting in the queue, not counting those being delivered
+var queueDepth = expvar.NewInt("queue_depth")
+
+// Queue delivers accepted messages in the background with a fixed number of
+// workers. At most depth messages may wait for a worker.
+type Queue struct {
+	deliver func(context.Context, *spool.Message)
+	depth   int
+	wg      sync.WaitGroup
+	// ctx is given to deliveries, it is cancelled when Drain gives up waiting
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// ready is signalled when a message is queued or the queue closes
+	ready   *sync.Cond
+	pending []*spool.Message
+	closed  bool
+	// stopped workers take no more messages, pending ones belong to Drain
+	stopped bool
+}
+
+// NewQueue starts workers goroutines calling deliver for each queued message.
+// Deliver is responsible for keeping any message it fails to deliver,
+// including when its context is cancelled by Drain.
+func NewQueue(workers int, depth int, deliver func(context.Context, *spool.Message)) *Queue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		deliver: deliver,
+		depth:   depth,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	q.ready = sync.NewCond(&q.mu)
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+// Submit queues the message, returning false without blocking if the queue is
+// full or draining.
+func (q *Queue) Submit(msg *spool.Message) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || len(q.pending) >= q.depth {
+		return false
+	}
+	q.pending = append(q.pending, msg)
+	queueDepth.Add(1)
+	q.ready.Signal()
+	return true
+}
+
+// Len returns how many messages are waiting for a worker
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Drain stops accepting messages and waits for the queued ones to be delivered
+// until ctx is done. Messages still waiting at that point are returned so they
+// can be kept for later, deliveries in progress are cancelled and Drain waits
+// for them to give up.
+func (q *Queue) Drain(ctx context.Context) []*spool.Message {
+	q.mu.Lock()
+	q.closed = true
+	q.ready.Broadcast()
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	q.stopped = true
+	unfinished := q.pending
+	q.pending = nil
+	queueDepth.Add(-int64(len(unfinished)))
+	q.ready.Broadcast()
+	q.mu.Unlock()
+	q.cancel()
+	<-done
+	return unfinished
+}
+
+// next waits for a message to deliver, it returns nil once the worker should
+// stop.
+func (q *Queue) next() *spool.Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) == 0 && !q.closed && !q.stopped {
+		q.ready.Wait()
+	}
+	if q.stopped || len(q.pending) == 0 {
+		return nil
+	}
+	msg := q.pending[0]
+	q.pending[0] = nil
+	q.pending = q.pending[1:]
+	queueDepth.Add(-1)
+	return msg
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for msg := q.next(); msg != nil; msg = q.next() {
+		q.deliver(q.ctx, msg)
+	}
+}
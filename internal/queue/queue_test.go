@@ -0,0 +1,128 @@
+package queue
+
+import (
+	"context"
+	"github.com/rktjmp/smtp-pigeon/internal/spool"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubmitDelivers(t *testing.T) {
+	assert := assert.New(t)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	delivered := map[string]bool{}
+	q := NewQueue(2, 10, func(ctx context.Context, msg *spool.Message) {
+		mu.Lock()
+		delivered[msg.ID] = true
+		mu.Unlock()
+		wg.Done()
+	})
+
+	wg.Add(3)
+	assert.True(q.Submit(&spool.Message{ID: "a"}))
+	assert.True(q.Submit(&spool.Message{ID: "b"}))
+	assert.True(q.Submit(&spool.Message{ID: "c"}))
+	wg.Wait()
+	assert.Equal(map[string]bool{"a": true, "b": true, "c": true}, delivered)
+}
+
+func TestSubmitWhenFull(t *testing.T) {
+	assert := assert.New(t)
+
+	block := make(chan struct{})
+	started := make(chan struct{}, 3)
+	q := NewQueue(1, 1, func(ctx context.Context, msg *spool.Message) {
+		started <- struct{}{}
+		<-block
+	})
+	defer close(block)
+
+	// one being delivered, one waiting, then full
+	assert.True(q.Submit(&spool.Message{ID: "a"}))
+	<-started
+	assert.True(q.Submit(&spool.Message{ID: "b"}))
+	assert.Equal(1, q.Len())
+	assert.False(q.Submit(&spool.Message{ID: "c"}))
+}
+
+func TestDrainWaitsForDelivery(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	delivered := []string{}
+	q := NewQueue(1, 10, func(ctx context.Context, msg *spool.Message) {
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		delivered = append(delivered, msg.ID)
+		mu.Unlock()
+	})
+
+	assert.True(q.Submit(&spool.Message{ID: "a"}))
+	assert.True(q.Submit(&spool.Message{ID: "b"}))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Empty(q.Drain(ctx))
+	assert.Equal([]string{"a", "b"}, delivered)
+	assert.False(q.Submit(&spool.Message{ID: "c"}))
+}
+
+func TestDrainReturnsUnfinished(t *testing.T) {
+	assert := assert.New(t)
+
+	started := make(chan struct{}, 1)
+	cancelled := make(chan string, 1)
+	q := NewQueue(1, 10, func(ctx context.Context, msg *spool.Message) {
+		started <- struct{}{}
+		<-ctx.Done()
+		// the delivery keeps what it couldn't deliver
+		cancelled <- msg.ID
+	})
+
+	assert.True(q.Submit(&spool.Message{ID: "a"}))
+	<-started
+	assert.True(q.Submit(&spool.Message{ID: "b"}))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	ids := []string{}
+	for _, msg := range q.Drain(ctx) {
+		ids = append(ids, msg.ID)
+	}
+	assert.Equal([]string{"b"}, ids, "the message being delivered isn't returned")
+	assert.Equal("a", <-cancelled)
+	assert.Equal(0, q.Len())
+}
+
+func TestDrainKeepsEveryMessageOnce(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	seen := map[string]int{}
+	q := NewQueue(4, 1000, func(ctx context.Context, msg *spool.Message) {
+		select {
+		case <-time.After(time.Millisecond):
+		case <-ctx.Done():
+		}
+		mu.Lock()
+		seen[msg.ID]++
+		mu.Unlock()
+	})
+	for i := 0; i < 500; i++ {
+		assert.True(q.Submit(&spool.Message{ID: strconv.Itoa(i)}))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	for _, msg := range q.Drain(ctx) {
+		seen[msg.ID]++
+	}
+
+	assert.Equal(500, len(seen))
+	for id, n := range seen {
+		assert.Equal(1, n, id)
+	}
+}
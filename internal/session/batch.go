@@ -0,0 +1,370 @@
+package session
+
+import (
+	"fmt"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/rktjmp/smtp-pigeon/internal/dispatch"
+	"github.com/rktjmp/smtp-pigeon/internal/spool"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batch collects a route's messages until its window passes or it is full.
+// Messages are written to a spool of their own until the batch is delivered,
+// along with the targets they still have to reach, so a restart carries on
+// where it left off.
+type batch struct {
+	sync.Mutex
+	route    string
+	spool    *spool.Spool
+	config   *config.Config
+	targets  []config.Target
+	messages []*spool.Message
+	// delivering are messages taken from the batch but still spooled
+	delivering []*spool.Message
+	// retrying are messages that didn't reach every target, they are retried
+	// on a timer of their own that backs off for each failed retry in a row
+	retrying   []*spool.Message
+	failures   int
+	timer      *time.Timer
+	retryTimer *time.Timer
+}
+
+// maxBatchRetryDelay caps how far retries of a failing batch back off
+const maxBatchRetryDelay = time.Hour
+
+// batches are shared by every session, keyed by route name
+var batches = struct {
+	sync.Mutex
+	shared map[string]*batch
+}{shared: map[string]*batch{}}
+
+// batchFor returns the route's batch, its spool is a subdirectory of the
+// config's spool.
+func batchFor(cfg *config.Config, route string) (*batch, error) {
+	batches.Lock()
+	defer batches.Unlock()
+	if b, ok := batches.shared[route]; ok {
+		return b, nil
+	}
+	if cfg.Spool == nil {
+		return nil, fmt.Errorf("batching requires a spool")
+	}
+	sp, err := cfg.Spool.Sub("batch-" + route)
+	if err != nil {
+		return nil, err
+	}
+	b := &batch{route: route, spool: sp}
+	batches.shared[route] = b
+	return b, nil
+}
+
+// batch adds the message to its route's batch instead of delivering it,
+// targets are the route's targets it still has to reach.
+func (s *Session) batch(targets []config.Target) error {
+	var all []config.Target
+	for _, target := range s.targets() {
+		if target.Route == targets[0].Route {
+			all = append(all, target)
+		}
+	}
+	msg := s.spoolMessage()
+	if len(targets) < len(all) {
+		msg.Pending = targetKeys(targets)
+	}
+	b, err := batchFor(s.config, targets[0].Route)
+	if err == nil {
+		err = b.add(s.config, all, msg)
+	}
+	if err != nil {
+		s.logger().Printf("%v: Batching for route %q failed: %v", s.id, targets[0].Route, err)
+		return errEndpointUnavailable
+	}
+	s.sent = true
+	s.logger().Printf("%v: Added to batch for route %q", s.id, targets[0].Route)
+	return nil
+}
+
+// add spools the message and adds it to the batch, delivering the batch in
+// the background if it is now full.
+func (b *batch) add(cfg *config.Config, targets []config.Target, msg *spool.Message) error {
+	if err := b.spool.Write(msg); err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.config, b.targets = cfg, targets
+	b.messages = append(b.messages, msg)
+	opts := targets[0].Batch
+	if opts.Max > 0 && len(b.messages) >= opts.Max {
+		go b.flush()
+	} else if b.timer == nil {
+		b.timer = time.AfterFunc(opts.Window, b.flush)
+	}
+	return nil
+}
+
+// use switches the batch to a new configuration of its route
+func (b *batch) use(cfg *config.Config, targets []config.Target) {
+	b.Lock()
+	defer b.Unlock()
+	b.config, b.targets = cfg, targets
+}
+
+// flush delivers the messages added since the last flush
+func (b *batch) flush() {
+	b.Lock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	messages := b.messages
+	b.messages = nil
+	b.Unlock()
+	b.deliver(messages, false)
+}
+
+// retry delivers the messages that didn't reach every target again
+func (b *batch) retry() {
+	b.Lock()
+	b.retryTimer = nil
+	messages := b.retrying
+	b.retrying = nil
+	b.Unlock()
+	b.deliver(messages, true)
+}
+
+// deliver delivers messages together with others that still have to reach
+// the same targets. Messages that don't reach every target are spooled with
+// the targets they still have to reach, and retried after the window, doubled
+// for each failed retry in a row.
+func (b *batch) deliver(messages []*spool.Message, retried bool) {
+	if len(messages) == 0 {
+		return
+	}
+	b.Lock()
+	cfg, targets := b.config, b.targets
+	b.delivering = append(b.delivering, messages...)
+	b.Unlock()
+
+	// group messages by the targets they still have to reach
+	var groups [][]*spool.Message
+	index := map[string]int{}
+	for _, msg := range messages {
+		key := strings.Join(msg.Pending, "\x00")
+		if msg.Pending == nil {
+			key = "\x00all"
+		}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], msg)
+	}
+
+	var kept []*spool.Message
+	for _, group := range groups {
+		var pending []config.Target
+		for _, target := range targets {
+			if group[0].Pending == nil || slices.Contains(group[0].Pending, target.Key()) {
+				pending = append(pending, target)
+			}
+		}
+		failed := deliverBatch(cfg, pending, group)
+		if len(failed) == 0 {
+			for _, msg := range group {
+				if err := b.spool.Remove(msg.ID); err != nil {
+					cfg.Logger().Printf("%v: Could not remove batched message from spool: %v", msg.ID, err)
+				}
+			}
+			continue
+		}
+		var left []string
+		for _, target := range pending {
+			if _, ok := failed[target.Key()]; ok {
+				left = append(left, target.Key())
+			}
+		}
+		for _, msg := range group {
+			msg.Pending = left
+			if err := b.spool.Write(msg); err != nil {
+				cfg.Logger().Printf("%v: Could not update batched message in spool: %v", msg.ID, err)
+			}
+		}
+		kept = append(kept, group...)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	finished := map[string]bool{}
+	for _, msg := range messages {
+		finished[msg.ID] = true
+	}
+	var still []*spool.Message
+	for _, msg := range b.delivering {
+		if !finished[msg.ID] {
+			still = append(still, msg)
+		}
+	}
+	b.delivering = still
+	if len(kept) == 0 {
+		if retried {
+			b.failures = 0
+		}
+		return
+	}
+	if retried || b.failures == 0 {
+		b.failures++
+	}
+	b.retrying = append(b.retrying, kept...)
+	if b.retryTimer == nil {
+		b.retryTimer = time.AfterFunc(retryDelay(targets[0].Batch.Window, b.failures), b.retry)
+	}
+}
+
+// targetKeys returns the targets' keys
+func targetKeys(targets []config.Target) []string {
+	keys := make([]string, len(targets))
+	for i, target := range targets {
+		keys[i] = target.Key()
+	}
+	return keys
+}
+
+// retryDelay is the window doubled for each failure after the first, up to
+// maxBatchRetryDelay but never less than the window.
+func retryDelay(window time.Duration, failures int) time.Duration {
+	delay := window
+	for i := 1; i < failures && delay < maxBatchRetryDelay; i++ {
+		delay *= 2
+	}
+	return max(window, min(delay, maxBatchRetryDelay))
+}
+
+// DeliverBatch renders the messages together with the targets' batch
+// template and delivers them to every target. The template's data is the
+// first message's with .Messages set to every message, so URL and header
+// templates work as they do for single messages.
+func DeliverBatch(cfg *config.Config, targets []config.Target, messages []*spool.Message) error {
+	failed := deliverBatch(cfg, targets, messages)
+	for _, target := range targets {
+		if err, ok := failed[target.Key()]; ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverBatch is DeliverBatch, returning the errors of the targets delivery
+// failed for by key.
+func deliverBatch(cfg *config.Config, targets []config.Target, messages []*spool.Message) map[string]error {
+	logger := cfg.Logger()
+	var all []*dispatch.TemplateData
+	for _, msg := range messages {
+		s := &Session{
+			id:        msg.ID,
+			config:    cfg,
+			timestamp: msg.Timestamp,
+			from:      msg.Sender,
+			to:        msg.Recipients,
+		}
+		if err := s.read(msg.Data); err != nil {
+			// it was accepted, so it parsed once
+			logger.Printf("%v: Could not parse batched message, leaving it out: %v", msg.ID, err)
+			continue
+		}
+		s.vars, _ = cfg.ApplyRules(s.ruleMessage())
+		data := s.TemplateData()
+		s.limit(data, targets[0])
+		all = append(all, data)
+	}
+	if len(all) == 0 || len(targets) == 0 {
+		return nil
+	}
+	data := *all[0]
+	data.Messages = all
+	ids := make([]string, len(all))
+	for i, d := range all {
+		ids[i] = d.ID
+	}
+	logger.Printf("Delivering batch of %d messages for route %q: %v", len(all), targets[0].Route, strings.Join(ids, ", "))
+
+	failed := map[string]error{}
+	for _, target := range targets {
+		status, resp, err := dispatch.Deliver(target.Endpoint, target.Batch.Template, &data)
+		if err != nil {
+			logger.Printf("Batch delivery (route %q, endpoint %q) failed: %v", target.Route, target.Endpoint.Name, err)
+			failed[target.Key()] = err
+			continue
+		}
+		logger.Printf("Batch delivery (route %q, endpoint %q) returned status: %v", target.Route, target.Endpoint.Name, status)
+		if resp != nil && !resp.OK() {
+			logger.Printf("Endpoint response: %v", resp)
+		}
+	}
+	return failed
+}
+
+// ResumeBatches points the batches of cfg's routes at cfg, and loads any
+// messages left spooled by a previous run. Call it at startup and after the
+// configuration is reloaded.
+func ResumeBatches(cfg *config.Config) {
+	logger := cfg.Logger()
+	for _, route := range cfg.Routes {
+		if route.Batch == nil {
+			continue
+		}
+		b, err := batchFor(cfg, route.Name)
+		if err != nil {
+			logger.Printf("Could not resume batch for route %q: %v", route.Name, err)
+			continue
+		}
+		b.use(cfg, route.Targets())
+		if err := b.resume(); err != nil {
+			logger.Printf("Could not resume batch for route %q: %v", route.Name, err)
+		}
+	}
+}
+
+// resume adds spooled messages the batch doesn't already have, its window
+// starts from the oldest message. Messages that already reached some of the
+// route's targets are retried after the window.
+func (b *batch) resume() error {
+	spooled, err := b.spool.Messages()
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	have := map[string]bool{}
+	for _, list := range [][]*spool.Message{b.messages, b.delivering, b.retrying} {
+		for _, msg := range list {
+			have[msg.ID] = true
+		}
+	}
+	for _, msg := range spooled {
+		switch {
+		case have[msg.ID]:
+		case msg.Pending != nil:
+			b.retrying = append(b.retrying, msg)
+		default:
+			b.messages = append(b.messages, msg)
+		}
+	}
+	if len(b.retrying) > 0 && b.retryTimer == nil {
+		b.retryTimer = time.AfterFunc(b.targets[0].Batch.Window, b.retry)
+	}
+	if len(b.messages) == 0 || b.timer != nil {
+		return nil
+	}
+	due := time.Until(b.messages[0].Timestamp.Add(b.targets[0].Batch.Window))
+	if due < 0 {
+		due = 0
+	}
+	b.timer = time.AfterFunc(due, b.flush)
+	return nil
+}
@@ -0,0 +1,226 @@
+package session
+
+import (
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/rktjmp/smtp-pigeon/internal/spool"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// batchConfig routes everything to a batching route posting to a server that
+// sends each body it receives on the returned channel
+func batchConfig(t *testing.T, route string, batch *config.BatchOptions) (*config.Config, chan string) {
+	bodies := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies <- string(b)
+	}))
+	t.Cleanup(server.Close)
+	// batches outlive sessions, don't leave one pointing at a removed spool
+	t.Cleanup(func() {
+		batches.Lock()
+		delete(batches.shared, route)
+		batches.Unlock()
+	})
+
+	sp, _ := spool.NewSpool(t.TempDir())
+	cfg, _ := config.NewConfig(server.URL, []string{}, "{{.ID}}", false)
+	cfg.Spool = sp
+	batch.Template, _ = config.ParseTemplate("batch", `{{len .Messages}}{{range .Messages}} {{.Header.Get "Subject"}}{{end}}`, nil)
+	cfg.Routes = []*config.Route{{Name: route, Endpoints: []*config.Endpoint{&cfg.Endpoint}, Batch: batch}}
+	return cfg, bodies
+}
+
+func TestBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, bodies := batchConfig(t, "batch-max", &config.BatchOptions{Window: time.Hour, Max: 2})
+	for _, subject := range []string{"one", "two"} {
+		session := NewSession(cfg)
+		session.Rcpt("you@host")
+		assert.Nil(session.Data(strings.NewReader("Subject: " + subject + "\n\nbody")))
+	}
+
+	select {
+	case body := <-bodies:
+		assert.Equal("2 one two", body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch was not delivered")
+	}
+	b, _ := batchFor(cfg, "batch-max")
+	assert.Eventually(func() bool {
+		messages, _ := b.spool.Messages()
+		return len(messages) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestBatchWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, bodies := batchConfig(t, "batch-window", &config.BatchOptions{Window: 50 * time.Millisecond})
+	session := NewSession(cfg)
+	session.Rcpt("you@host")
+	assert.Nil(session.Data(strings.NewReader("Subject: alone\n\nbody")))
+
+	select {
+	case body := <-bodies:
+		assert.Equal("1 alone", body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch was not delivered")
+	}
+}
+
+func TestResumeBatches(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, bodies := batchConfig(t, "batch-resume", &config.BatchOptions{Window: time.Minute})
+	// left by a previous run, its window has already passed
+	sp, _ := cfg.Spool.Sub("batch-batch-resume")
+	sp.Write(&spool.Message{ID: "old", Timestamp: time.Now().Add(-time.Hour), Data: "Subject: old\n\nbody"})
+
+	ResumeBatches(cfg)
+	select {
+	case body := <-bodies:
+		assert.Equal("1 old", body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch was not resumed")
+	}
+}
+
+func TestBatchRetriesFailedEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, bodies := batchConfig(t, "batch-retry", &config.BatchOptions{Window: 20 * time.Millisecond})
+	flakyBatchEndpoint(t, cfg, bodies, 1)
+
+	session := NewSession(cfg)
+	session.Rcpt("you@host")
+	assert.Nil(session.Data(strings.NewReader("Subject: once\n\nbody")))
+
+	var received []string
+	for len(received) < 2 {
+		select {
+		case body := <-bodies:
+			received = append(received, body)
+		case <-time.After(5 * time.Second):
+			t.Fatal("batch was not retried")
+		}
+	}
+	assert.Equal([]string{"1 once", "flaky 1 once"}, received)
+
+	// the endpoint that got it first doesn't get it again
+	b, _ := batchFor(cfg, "batch-retry")
+	assert.Eventually(func() bool {
+		messages, _ := b.spool.Messages()
+		return len(messages) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	select {
+	case body := <-bodies:
+		t.Fatalf("unexpected delivery %q", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// flakyBatchEndpoint adds an endpoint to the batch route that hangs up on
+// the first fails requests, and sends the bodies it receives after that on
+// bodies prefixed with "flaky"
+func flakyBatchEndpoint(t *testing.T, cfg *config.Config, bodies chan string, fails int32) {
+	var remaining atomic.Int32
+	remaining.Store(fails)
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if remaining.Add(-1) >= 0 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		bodies <- "flaky " + string(b)
+	}))
+	t.Cleanup(flaky.Close)
+	other, _ := config.NewEndpoint("flaky", flaky.URL, []string{}, "{{.ID}}", nil)
+	cfg.Routes[0].Endpoints = append(cfg.Routes[0].Endpoints, other)
+}
+
+func TestResumeBatchesToPendingTargets(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, bodies := batchConfig(t, "batch-resume-pending", &config.BatchOptions{Window: 20 * time.Millisecond})
+	flakyBatchEndpoint(t, cfg, bodies, 0)
+	// a previous run reached the first endpoint
+	sp, _ := cfg.Spool.Sub("batch-batch-resume-pending")
+	sp.Write(&spool.Message{ID: "old", Timestamp: time.Now(), Data: "Subject: old\n\nbody", Pending: []string{"batch-resume-pending/flaky"}})
+
+	ResumeBatches(cfg)
+	select {
+	case body := <-bodies:
+		assert.Equal("flaky 1 old", body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch was not resumed")
+	}
+	select {
+	case body := <-bodies:
+		t.Fatalf("unexpected delivery %q", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBatchBackoffOnlyDelaysRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, bodies := batchConfig(t, "batch-backoff", &config.BatchOptions{Window: 20 * time.Millisecond})
+	flakyBatchEndpoint(t, cfg, bodies, 100)
+	b, _ := batchFor(cfg, "batch-backoff")
+
+	session := NewSession(cfg)
+	session.Rcpt("you@host")
+	assert.Nil(session.Data(strings.NewReader("Subject: first\n\nbody")))
+	assert.Equal("1 first", <-bodies)
+
+	// the failed endpoint's retry is spooled and backing off
+	assert.Eventually(func() bool {
+		b.Lock()
+		defer b.Unlock()
+		if b.retryTimer == nil || len(b.retrying) == 0 {
+			return false
+		}
+		b.retryTimer.Reset(time.Hour)
+		return true
+	}, 5*time.Second, time.Millisecond)
+	messages, _ := b.spool.Messages()
+	if assert.Equal(1, len(messages)) {
+		assert.Equal([]string{"batch-backoff/flaky"}, messages[0].Pending)
+	}
+
+	// new mail goes out after the window regardless
+	session = NewSession(cfg)
+	session.Rcpt("you@host")
+	assert.Nil(session.Data(strings.NewReader("Subject: second\n\nbody")))
+	select {
+	case body := <-bodies:
+		assert.Equal("1 second", body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("new mail waited for the retry")
+	}
+	// and its failed endpoint joins the retry
+	assert.Eventually(func() bool {
+		b.Lock()
+		defer b.Unlock()
+		return len(b.retrying) == 2
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestBatchRetryDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(time.Minute, retryDelay(time.Minute, 1))
+	assert.Equal(2*time.Minute, retryDelay(time.Minute, 2))
+	assert.Equal(8*time.Minute, retryDelay(time.Minute, 4))
+	assert.Equal(maxBatchRetryDelay, retryDelay(time.Minute, 100))
+	assert.Equal(2*time.Hour, retryDelay(2*time.Hour, 3), "never less than the window")
+}
@@ -0,0 +1,88 @@
+package session
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+)
+
+// duplicatesSuppressed counts messages accepted without delivery as duplicates
+var duplicatesSuppressed = expvar.NewInt("duplicates_suppressed")
+
+// accepted is the first message accepted with a fingerprint
+type accepted struct {
+	id         string
+	expires    time.Time
+	duplicates int
+}
+
+// fingerprints of accepted messages are shared by every session, so they
+// outlive configuration reloads
+var fingerprints = struct {
+	sync.Mutex
+	shared map[string]*accepted
+	swept  time.Time
+}{shared: map[string]*accepted{}}
+
+// fingerprint identifies the message for duplicate suppression, it is empty
+// when there is nothing to identify it by.
+func (s *Session) fingerprint() (string, error) {
+	var key string
+	if tmpl := s.config.Dedup.Key; tmpl != nil {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, s.TemplateData()); err != nil {
+			return "", err
+		}
+		key = b.String()
+	} else if id := strings.TrimSpace(s.message.Header.Get("Message-ID")); id != "" {
+		key = "message-id\x00" + id
+	} else {
+		key = strings.Join([]string{"content", s.from, s.message.Header.Get("Subject"), s.body}, "\x00")
+	}
+	if strings.TrimSpace(key) == "" {
+		return "", nil
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// reserve records the message as accepted with the fingerprint unless it is a
+// duplicate. If it is, the ID of the message first accepted with the
+// fingerprint and how many duplicates of it there have been, counting this one,
+// are returned instead. Checking and reserving at once means only one of
+// several concurrent duplicates is delivered. Later messages with the
+// fingerprint are duplicates until ttl has passed or the reservation is
+// released.
+func reserve(fingerprint string, id string, ttl time.Duration) (string, int, bool) {
+	fingerprints.Lock()
+	defer fingerprints.Unlock()
+	now := time.Now()
+	if now.Sub(fingerprints.swept) > time.Minute {
+		for key, original := range fingerprints.shared {
+			if now.After(original.expires) {
+				delete(fingerprints.shared, key)
+			}
+		}
+		fingerprints.swept = now
+	}
+	if original, ok := fingerprints.shared[fingerprint]; ok && !now.After(original.expires) {
+		original.duplicates++
+		return original.id, original.duplicates, true
+	}
+	fingerprints.shared[fingerprint] = &accepted{id: id, expires: now.Add(ttl)}
+	return "", 0, false
+}
+
+// release forgets the message's reservation of the fingerprint, when it
+// wasn't accepted after all.
+func release(fingerprint string, id string) {
+	fingerprints.Lock()
+	defer fingerprints.Unlock()
+	if original, ok := fingerprints.shared[fingerprint]; ok && original.id == id {
+		delete(fingerprints.shared, fingerprint)
+	}
+}
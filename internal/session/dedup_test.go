@@ -0,0 +1,121 @@
+package session
+
+import (
+	"github.com/emersion/go-smtp"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dedupConfig suppresses duplicates for a minute, deliveries are counted
+func dedupConfig(t *testing.T, key string) (*config.Config, *int32) {
+	var delivered int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&delivered, 1)
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() {
+		fingerprints.Lock()
+		fingerprints.shared = map[string]*accepted{}
+		fingerprints.Unlock()
+	})
+
+	cfg, _ := config.NewConfig(server.URL, []string{}, "{{.ID}}", false)
+	cfg.Dedup = &config.DedupOptions{TTL: time.Minute}
+	if key != "" {
+		cfg.Dedup.Key, _ = config.ParseTemplate("dedup-key", key, nil)
+	}
+	return cfg, &delivered
+}
+
+func send(cfg *config.Config, from string, data string) error {
+	session := NewSession(cfg)
+	session.Mail(from, smtp.MailOptions{})
+	session.Rcpt("you@host")
+	return session.Data(strings.NewReader(data))
+}
+
+func TestDedupMessageID(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, delivered := dedupConfig(t, "")
+	assert.Nil(send(cfg, "a@host", "Message-ID: <dedup-1@host>\nSubject: one\n\nbody"))
+	assert.Nil(send(cfg, "b@host", "Message-ID: <dedup-1@host>\nSubject: two\n\nother"))
+	assert.Equal(int32(1), atomic.LoadInt32(delivered))
+
+	assert.Nil(send(cfg, "a@host", "Message-ID: <dedup-2@host>\nSubject: one\n\nbody"))
+	assert.Equal(int32(2), atomic.LoadInt32(delivered))
+}
+
+func TestDedupContent(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, delivered := dedupConfig(t, "")
+	assert.Nil(send(cfg, "cron@dedup", "Subject: backup failed\n\ndisk full"))
+	assert.Nil(send(cfg, "cron@dedup", "Subject: backup failed\n\ndisk full"))
+	assert.Equal(int32(1), atomic.LoadInt32(delivered))
+
+	assert.Nil(send(cfg, "cron@dedup", "Subject: backup failed\n\nno route to host"))
+	assert.Nil(send(cfg, "other@dedup", "Subject: backup failed\n\ndisk full"))
+	assert.Equal(int32(3), atomic.LoadInt32(delivered))
+}
+
+func TestDedupKey(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, delivered := dedupConfig(t, `dedup-key {{.Header.Get "X-Alert"}}`)
+	assert.Nil(send(cfg, "a@host", "X-Alert: disk\nSubject: one\n\nbody"))
+	assert.Nil(send(cfg, "b@host", "X-Alert: disk\nSubject: two\n\nother"))
+	assert.Nil(send(cfg, "a@host", "X-Alert: cpu\nSubject: one\n\nbody"))
+	assert.Equal(int32(2), atomic.LoadInt32(delivered))
+}
+
+func TestDedupOnlyAccepted(t *testing.T) {
+	assert := assert.New(t)
+
+	down, _ := dedupConfig(t, "")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.URL, _ = config.ParseTemplate("url", server.URL, nil)
+	server.Close()
+	data := "Message-ID: <dedup-retry@host>\n\nbody"
+	assert.NotNil(send(down, "a@host", data))
+
+	// the client's retry isn't a duplicate
+	cfg, delivered := dedupConfig(t, "")
+	assert.Nil(send(cfg, "a@host", data))
+	assert.Equal(int32(1), atomic.LoadInt32(delivered))
+}
+
+func TestDedupExpires(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, delivered := dedupConfig(t, "")
+	cfg.Dedup.TTL = time.Millisecond
+	data := "Message-ID: <dedup-expires@host>\n\nbody"
+	assert.Nil(send(cfg, "a@host", data))
+	time.Sleep(5 * time.Millisecond)
+	assert.Nil(send(cfg, "a@host", data))
+	assert.Equal(int32(2), atomic.LoadInt32(delivered))
+}
+
+func TestDedupConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, delivered := dedupConfig(t, "")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(send(cfg, "a@host", "Message-ID: <dedup-concurrent@host>\n\nbody"))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(int32(1), atomic.LoadInt32(delivered))
+}
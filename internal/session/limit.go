@@ -0,0 +1,65 @@
+package session
+
+import (
+	"github.com/emersion/go-smtp"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/rktjmp/smtp-pigeon/internal/dispatch"
+	"net/textproto"
+	"strings"
+)
+
+// errTooBig refuses mail larger than every route it matches accepts
+var errTooBig = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+	Message:      "Message too big",
+}
+
+// checkSize leaves out the targets whose routes the message is too big for.
+// It is refused when that is every target, unless it was already accepted.
+func (s *Session) checkSize(targets []config.Target) ([]config.Target, error) {
+	var kept []config.Target
+	for _, target := range targets {
+		if !target.Limits.Rejects(len(s.data)) {
+			kept = append(kept, target)
+			continue
+		}
+		s.logger().Printf("%v: Delivery%v skipped, %d bytes is over %d", s.id, s.describe(target), len(s.data), target.Limits.RejectAbove)
+	}
+	if len(kept) == 0 && len(targets) > 0 && !s.redelivery {
+		s.logger().Printf("%v: Too big for every route", s.id)
+		return nil, errTooBig
+	}
+	return kept, nil
+}
+
+// limit applies the target's route limits to what its template sees of the
+// message. .Data keeps its headers, the rest of it is the new body.
+func (s *Session) limit(data *dispatch.TemplateData, target config.Target) {
+	opts := target.Limits
+	if opts == nil {
+		return
+	}
+	if opts.DropAttachmentsAbove > 0 {
+		body, dropped := dropAttachments(textproto.MIMEHeader(data.Header), data.Body, opts.DropAttachmentsAbove)
+		if dropped > 0 {
+			s.logger().Printf("%v: Dropped %d attachments over %d bytes for route %q", s.id, dropped, opts.DropAttachmentsAbove, target.Route)
+			data.Data = headerSection(data.Data) + body
+			data.Body = body
+		}
+	}
+	data.Body = opts.Truncate(data.Body)
+	data.Text = opts.Truncate(data.Text)
+	data.HTML = opts.Truncate(data.HTML)
+}
+
+// headerSection returns the raw message's headers and the blank line after them
+func headerSection(data string) string {
+	end := len(data)
+	for _, blank := range []string{"\r\n\r\n", "\n\n"} {
+		if i := strings.Index(data, blank); i >= 0 && i+len(blank) < end {
+			end = i + len(blank)
+		}
+	}
+	return data[:end]
+}
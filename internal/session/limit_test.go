@@ -0,0 +1,83 @@
+package session
+
+import (
+	"github.com/emersion/go-smtp"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDataLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	bodies := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies[r.URL.Path] = string(b)
+	}))
+	defer server.Close()
+
+	cfg, _ := config.NewConfig(server.URL, []string{}, "{{.ID}}", false)
+	chat, _ := config.NewEndpoint("chat", server.URL+"/chat", nil, "{{.Text}}", nil)
+	archive, _ := config.NewEndpoint("archive", server.URL+"/archive", nil, "{{.Text}}", nil)
+	cfg.Routes = []*config.Route{
+		{
+			Name:      "chat",
+			Endpoints: []*config.Endpoint{chat},
+			Limits:    &config.LimitOptions{MaxBodyChars: 5, TruncationMarker: "…", RejectAbove: 1000},
+			Continue:  true,
+		},
+		{Name: "archive", Endpoints: []*config.Endpoint{archive}},
+	}
+
+	assert.Nil(send(cfg, "a@host", "Subject: log\n\nline one\nline two"))
+	assert.Equal("line …", bodies["/chat"])
+	assert.Equal("line one\nline two", bodies["/archive"])
+
+	// only the route with the limit misses out
+	delete(bodies, "/chat")
+	assert.Nil(send(cfg, "a@host", "Subject: log\n\n"+strings.Repeat("x", 1000)))
+	assert.Empty(bodies["/chat"])
+	assert.Equal(strings.Repeat("x", 1000), bodies["/archive"])
+
+	// already accepted, the same
+	session := &Session{id: "queued", config: cfg, to: []string{"you@host"}, redelivery: true}
+	assert.Nil(session.Data(strings.NewReader("Subject: log\n\n" + strings.Repeat("y", 1000))))
+	assert.Empty(bodies["/chat"])
+	assert.Equal(strings.Repeat("y", 1000), bodies["/archive"])
+
+	// too big for every route it matches, it is refused
+	cfg.Routes[0].Continue = false
+	delete(bodies, "/archive")
+	err := send(cfg, "a@host", "Subject: log\n\n"+strings.Repeat("z", 1000))
+	if smtpErr, ok := err.(*smtp.SMTPError); assert.True(ok) {
+		assert.Equal(552, smtpErr.Code)
+		assert.Equal(smtp.EnhancedCode{5, 3, 4}, smtpErr.EnhancedCode)
+	}
+	assert.Empty(bodies["/chat"])
+	assert.Empty(bodies["/archive"])
+}
+
+func TestLimitDropsAttachments(t *testing.T) {
+	assert := assert.New(t)
+
+	data := "Content-Type: multipart/mixed; boundary=b\n\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nhi\r\n" +
+		"--b\r\nContent-Disposition: attachment; filename=dump.log\r\n\r\n" + strings.Repeat("z", 100) + "\r\n" +
+		"--b--\r\n"
+	cfg, _ := config.NewConfig("http://localhost", []string{}, "{{.ID}}", false)
+	session := NewSession(cfg)
+	assert.Nil(session.read(data))
+
+	templateData := session.TemplateData()
+	session.limit(templateData, config.Target{Route: "chat", Limits: &config.LimitOptions{DropAttachmentsAbove: 50}})
+	assert.NotContains(templateData.Body, "dump.log")
+	assert.True(strings.HasPrefix(templateData.Data, "Content-Type: multipart/mixed; boundary=b\n\n--b\r\n"))
+	assert.NotContains(templateData.Data, "dump.log")
+	assert.Equal("hi", templateData.Text)
+	assert.Contains(session.body, "dump.log", "the session keeps the message as sent")
+}
@@ -0,0 +1,212 @@
+package session
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// maxPartDepth stops pathologically nested multipart messages
+const maxPartDepth = 10
+
+// textParts returns the first text/plain and text/html parts of a message
+// that aren't attachments, decoded from their transfer encoding. A message
+// that isn't multipart is a single part, plain text unless it says otherwise.
+func textParts(header textproto.MIMEHeader, body string) (text string, html string) {
+	var foundText, foundHTML bool
+	walkParts(header, strings.NewReader(body), 0, func(mediaType string, content string) {
+		switch {
+		case mediaType == "text/plain" && !foundText:
+			text, foundText = content, true
+		case mediaType == "text/html" && !foundHTML:
+			html, foundHTML = content, true
+		}
+	})
+	return text, html
+}
+
+func walkParts(header textproto.MIMEHeader, body io.Reader, depth int, visit func(mediaType string, content string)) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxPartDepth {
+			return
+		}
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err != nil {
+				return
+			}
+			walkParts(part.Header, part, depth+1, visit)
+		}
+	}
+	if disposition, _, _ := mime.ParseMediaType(header.Get("Content-Disposition")); disposition == "attachment" {
+		return
+	}
+	if !strings.HasPrefix(mediaType, "text/") {
+		return
+	}
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return
+	}
+	visit(mediaType, string(b))
+}
+
+// dropAttachments removes attachments larger than above bytes, once decoded,
+// from a multipart body, returning the body and how many were dropped. A body
+// that can't be read is returned as it is.
+func dropAttachments(header textproto.MIMEHeader, body string, above int) (string, int) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return body, 0
+	}
+	dropped := 0
+	rewritten, ok := rewriteParts(body, params["boundary"], 0, func(header textproto.MIMEHeader, content string) (string, bool) {
+		if isAttachment(header) && decodedSize(header, []byte(content)) > above {
+			dropped++
+			return "", false
+		}
+		return content, true
+	})
+	if !ok {
+		return body, 0
+	}
+	return rewritten, dropped
+}
+
+// rewriteParts rebuilds a multipart body with each part that isn't itself
+// multipart replaced by the content rewrite returns, or left out when it
+// returns false. It reports whether anything changed, a body that can't be
+// read or where nothing changed is returned exactly as it was sent.
+func rewriteParts(body string, boundary string, depth int, rewrite func(header textproto.MIMEHeader, content string) (string, bool)) (string, bool) {
+	if depth >= maxPartDepth {
+		return body, false
+	}
+	var b strings.Builder
+	writer := multipart.NewWriter(&b)
+	if err := writer.SetBoundary(boundary); err != nil {
+		return body, false
+	}
+	reader := multipart.NewReader(strings.NewReader(body), boundary)
+	changed := false
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return body, false
+		}
+		raw, err := io.ReadAll(part)
+		if err != nil {
+			return body, false
+		}
+		content := string(raw)
+		mediaType, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if strings.HasPrefix(mediaType, "multipart/") {
+			nested, ok := rewriteParts(content, params["boundary"], depth+1, rewrite)
+			content, changed = nested, changed || ok
+		} else {
+			rewritten, keep := rewrite(part.Header, content)
+			if !keep {
+				changed = true
+				continue
+			}
+			content, changed = rewritten, changed || rewritten != content
+		}
+		w, err := writer.CreatePart(part.Header)
+		if err != nil {
+			return body, false
+		}
+		io.WriteString(w, content)
+	}
+	if !changed {
+		return body, false
+	}
+	writer.Close()
+	return b.String(), true
+}
+
+// isAttachment reports whether a part is an attachment, or an inline file
+func isAttachment(header textproto.MIMEHeader) bool {
+	disposition, params, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if disposition == "attachment" || params["filename"] != "" {
+		return true
+	}
+	_, params, _ = mime.ParseMediaType(header.Get("Content-Type"))
+	return params["name"] != ""
+}
+
+// decodedSize is the size of a part's content once its transfer encoding is
+// decoded
+func decodedSize(header textproto.MIMEHeader, content []byte) int {
+	var r io.Reader = bytes.NewReader(content)
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	default:
+		return len(content)
+	}
+	n, _ := io.Copy(io.Discard, r)
+	return int(n)
+}
+
+// decodeContent decodes raw content from a transfer encoding, reporting
+// false if it isn't base64 or quoted-printable or can't be decoded.
+func decodeContent(encoding string, raw string) (string, bool) {
+	var r io.Reader = strings.NewReader(raw)
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	default:
+		return "", false
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// encodeContent encodes decoded content in a transfer encoding, base64 or
+// quoted-printable, with the line endings of the raw content it replaces.
+func encodeContent(encoding string, content string, raw string) string {
+	var b strings.Builder
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		w := quotedprintable.NewWriter(&b)
+		io.WriteString(w, content)
+		w.Close()
+	case "base64":
+		encoded := base64.StdEncoding.EncodeToString([]byte(content))
+		for len(encoded) > 76 {
+			b.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		b.WriteString(encoded)
+	default:
+		return content
+	}
+	if !strings.Contains(raw, "\r\n") {
+		return strings.ReplaceAll(b.String(), "\r\n", "\n")
+	}
+	return b.String()
+}
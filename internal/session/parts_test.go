@@ -0,0 +1,76 @@
+package session
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/textproto"
+	"testing"
+)
+
+func TestTextParts(t *testing.T) {
+	assert := assert.New(t)
+
+	header := textproto.MIMEHeader{"Content-Type": {`multipart/mixed; boundary="outer"`}}
+	body := "--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"caf=C3=A9 =\r\nclosed\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		"PHA+Y2Fmw6k8L3A+\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Disposition: attachment; filename=log.txt\r\n\r\n" +
+		"attached\r\n" +
+		"--outer--\r\n"
+
+	text, html := textParts(header, body)
+	assert.Equal("café closed", text)
+	assert.Equal("<p>café</p>", html)
+
+	text, html = textParts(textproto.MIMEHeader{}, "just text")
+	assert.Equal("just text", text)
+	assert.Equal("", html)
+
+	text, html = textParts(textproto.MIMEHeader{"Content-Type": {"text/html"}}, "<b>hi</b>")
+	assert.Equal("", text)
+	assert.Equal("<b>hi</b>", html)
+}
+
+func TestDropAttachments(t *testing.T) {
+	assert := assert.New(t)
+
+	header := textproto.MIMEHeader{"Content-Type": {`multipart/mixed; boundary="b"`}}
+	body := "--b\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"see attached\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/octet-stream; name=big.bin\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		"AAAAAAAAAAAA\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Disposition: attachment; filename=small.txt\r\n\r\n" +
+		"tiny\r\n" +
+		"--b--\r\n"
+
+	// 9 bytes once decoded
+	out, dropped := dropAttachments(header, body, 8)
+	assert.Equal(1, dropped)
+	assert.NotContains(out, "big.bin")
+	assert.Contains(out, "see attached")
+	assert.Contains(out, "small.txt")
+	text, _ := textParts(header, out)
+	assert.Equal("see attached", text)
+
+	out, dropped = dropAttachments(header, body, 9)
+	assert.Equal(0, dropped)
+	assert.Equal(body, out)
+
+	out, dropped = dropAttachments(textproto.MIMEHeader{}, "plain", 1)
+	assert.Equal(0, dropped)
+	assert.Equal("plain", out)
+}
@@ -0,0 +1,187 @@
+package session
+
+import (
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/rktjmp/smtp-pigeon/internal/dispatch"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// redact applies the config's redactions to what templates see of the
+// message, and to the envelope and subject that sinks log alongside it. The
+// count is of the raw message or, if more, its decoded text parts, so a plain
+// text body isn't counted twice, plus the envelope's.
+//
+// Encoded text parts and RFC 2047 headers in the raw .Data and .Body are
+// decoded too, and if that reveals something to redact they are replaced by
+// the redacted text, encoded the same way.
+func (s *Session) redact(data *dispatch.TemplateData) {
+	if s.config == nil || !s.config.Redact.Enabled() {
+		return
+	}
+	opts := s.config.Redact
+	var inData, inText, inHTML, inEnvelope int
+	data.Data, inData = redactRaw(opts, data.Data)
+	data.Body, _ = redactBody(opts, textproto.MIMEHeader(data.Header), data.Body)
+	data.Text, inText = opts.Redact(data.Text)
+	data.HTML, inHTML = opts.Redact(data.HTML)
+	data.Subject, _ = opts.Redact(data.Subject)
+
+	var n int
+	data.Sender, inEnvelope = opts.Redact(data.Sender)
+	recipients := make([]string, len(data.Recipients))
+	for i, recipient := range data.Recipients {
+		recipients[i], n = opts.Redact(recipient)
+		inEnvelope += n
+	}
+	data.Recipients = recipients
+	if redacted, _ := opts.Redact(data.Recipient.Address); redacted != data.Recipient.Address {
+		data.Recipient = dispatch.NewAddress(redacted)
+	}
+	data.Redactions = max(inData, inText+inHTML) + inEnvelope
+
+	if len(opts.Headers) == 0 {
+		return
+	}
+	// the parsed message's header is shared, redact a copy
+	header := make(mail.Header, len(data.Header))
+	for name, values := range data.Header {
+		header[name] = values
+	}
+	for _, name := range opts.Headers {
+		if _, ok := header[name]; !ok {
+			continue
+		}
+		values := make([]string, len(header[name]))
+		for i, value := range header[name] {
+			values[i] = redactHeader(opts, value)
+		}
+		header[name] = values
+	}
+	data.Header = header
+}
+
+// redactHeader redacts the value, decoding it first if it is RFC 2047 encoded
+// and the decoded text has something to redact.
+func redactHeader(opts *config.RedactOptions, value string) string {
+	if decoded, ok := decodeHeader(value); ok {
+		if redacted, n := opts.Redact(decoded); n > 0 {
+			return redacted
+		}
+	}
+	redacted, _ := opts.Redact(value)
+	return redacted
+}
+
+// decodeHeader decodes RFC 2047 encoded words, reporting whether there were
+// any.
+func decodeHeader(value string) (string, bool) {
+	var decoder mime.WordDecoder
+	decoded, err := decoder.DecodeHeader(value)
+	if err != nil || decoded == value {
+		return "", false
+	}
+	return decoded, true
+}
+
+// redactRaw redacts a raw message as it was sent, then its encoded headers
+// and text parts once decoded.
+func redactRaw(opts *config.RedactOptions, raw string) (string, int) {
+	raw, count := opts.Redact(raw)
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return raw, count
+	}
+	header := headerSection(raw)
+	redactedHeader, inHeader := redactEncodedHeaders(opts, header)
+	body, inBody := redactEncodedParts(opts, textproto.MIMEHeader(msg.Header), raw[len(header):])
+	return redactedHeader + body, count + inHeader + inBody
+}
+
+// redactBody redacts a raw body as it was sent, then its encoded text parts
+// once decoded.
+func redactBody(opts *config.RedactOptions, header textproto.MIMEHeader, body string) (string, int) {
+	body, count := opts.Redact(body)
+	body, n := redactEncodedParts(opts, header, body)
+	return body, count + n
+}
+
+// redactEncodedHeaders replaces the RFC 2047 encoded fields of a raw header
+// section that have something to redact once decoded, leaving the rest as
+// they were sent.
+func redactEncodedHeaders(opts *config.RedactOptions, section string) (string, int) {
+	var fields []string
+	for _, line := range strings.SplitAfter(section, "\n") {
+		if len(fields) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			fields[len(fields)-1] += line
+		} else if line != "" {
+			fields = append(fields, line)
+		}
+	}
+	var b strings.Builder
+	count := 0
+	for _, field := range fields {
+		name, value, ok := strings.Cut(field, ":")
+		if ok {
+			unfolded := strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(value))
+			if decoded, ok := decodeHeader(unfolded); ok {
+				if redacted, n := opts.Redact(decoded); n > 0 {
+					newline := "\n"
+					if strings.HasSuffix(field, "\r\n") {
+						newline = "\r\n"
+					}
+					field = name + ": " + mime.QEncoding.Encode("utf-8", redacted) + newline
+					count += n
+				}
+			}
+		}
+		b.WriteString(field)
+	}
+	return b.String(), count
+}
+
+// redactEncodedParts replaces the base64 or quoted-printable text parts of a
+// raw body that have something to redact once decoded with the redacted
+// text, encoded the same way.
+func redactEncodedParts(opts *config.RedactOptions, header textproto.MIMEHeader, body string) (string, int) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		if !strings.HasPrefix(mediaType, "text/") {
+			return body, 0
+		}
+		return redactEncoded(opts, header.Get("Content-Transfer-Encoding"), body)
+	}
+	count := 0
+	rewritten, ok := rewriteParts(body, params["boundary"], 0, func(header textproto.MIMEHeader, content string) (string, bool) {
+		// a part without a type is plain text
+		if mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil && !strings.HasPrefix(mediaType, "text/") {
+			return content, true
+		}
+		content, n := redactEncoded(opts, header.Get("Content-Transfer-Encoding"), content)
+		count += n
+		return content, true
+	})
+	if !ok {
+		return body, 0
+	}
+	return rewritten, count
+}
+
+// redactEncoded redacts content once decoded from its transfer encoding,
+// returning it encoded again if there was anything to redact.
+func redactEncoded(opts *config.RedactOptions, encoding string, content string) (string, int) {
+	decoded, ok := decodeContent(encoding, content)
+	if !ok {
+		return content, 0
+	}
+	redacted, n := opts.Redact(decoded)
+	if n == 0 {
+		return content, 0
+	}
+	return encodeContent(encoding, redacted, content), n
+}
@@ -0,0 +1,51 @@
+package session
+
+import (
+	"github.com/emersion/go-smtp"
+	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestDataRules(t *testing.T) {
+	assert := assert.New(t)
+
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, r.URL.Path+" "+string(b))
+	}))
+	defer server.Close()
+
+	cfg, _ := config.NewConfig(server.URL, []string{}, "{{.ID}}", false)
+	pager, _ := config.NewEndpoint("pager", server.URL+"/pager", nil, `{{index .Vars "severity"}}`, nil)
+	chat, _ := config.NewEndpoint("chat", server.URL+"/chat", nil, `{{.Header.Get "Subject"}}`, nil)
+	pagerRoute := &config.Route{Name: "pager", Endpoints: []*config.Endpoint{pager}}
+	cfg.Routes = []*config.Route{
+		{Name: "chat", Endpoints: []*config.Endpoint{chat}},
+		pagerRoute,
+	}
+	cfg.Rules = []*config.Rule{
+		{Name: "noise", Subject: regexp.MustCompile("run-parts"), Action: config.RuleDrop},
+		{Name: "spam", Sender: regexp.MustCompile("^spam@"), Action: config.RuleReject, Message: "No thanks"},
+		{Name: "severity", Body: regexp.MustCompile("FAILED"), Action: config.RuleSet, Vars: map[string]string{"severity": "critical"}},
+		{Name: "escalate", Body: regexp.MustCompile("FAILED"), Action: config.RuleRouteTo, Route: pagerRoute},
+	}
+
+	assert.Nil(send(cfg, "root@host", "Subject: Cron run-parts\n\nnoise"))
+	assert.Empty(bodies)
+
+	err := send(cfg, "spam@host", "Subject: hi\n\nbuy")
+	if smtpErr, ok := err.(*smtp.SMTPError); assert.True(ok) {
+		assert.Equal(550, smtpErr.Code)
+		assert.Equal("No thanks", smtpErr.Message)
+	}
+
+	assert.Nil(send(cfg, "root@host", "Subject: backup\n\nbackup FAILED"))
+	assert.Nil(send(cfg, "root@host", "Subject: backup\n\nbackup ok"))
+	assert.Equal([]string{"/pager critical", "/chat backup"}, bodies)
+}
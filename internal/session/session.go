@@ -1,13 +1,20 @@
 package session
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/emersion/go-smtp"
 	"github.com/google/uuid"
 	"github.com/rktjmp/smtp-pigeon/internal/config"
 	"github.com/rktjmp/smtp-pigeon/internal/dispatch"
+	"github.com/rktjmp/smtp-pigeon/internal/spool"
 	"io"
 	"log"
+	"mime"
 	"net/mail"
+	"net/textproto"
+	"slices"
 	"strings"
 	"time"
 )
@@ -24,6 +31,24 @@ type Session struct {
 	data      string
 	message   *mail.Message
 	body      string
+	text      string
+	html      string
+	responses []*dispatch.Response
+	// vars and route are set by rules
+	vars  map[string]string
+	route *config.Route
+	// redelivery sessions deliver a message that was already accepted, from
+	// the queue or spool
+	redelivery bool
+	// pending are the keys of the targets a redelivery still has to reach, nil
+	// for all of them
+	pending []string
+	// deferred are the keys of the targets left for the spool, failed those
+	// that could not be delivered to
+	deferred []string
+	failed   []string
+	// ctx cancels deliveries, nil for none
+	ctx context.Context
 }
 
 // NewSession creates a fresh session with a generated UUID and timestamp
@@ -34,13 +59,13 @@ func NewSession(config *config.Config) *Session {
 		config:    config,
 		timestamp: time.Now(),
 	}
-	log.Printf("%v: New session", s.id)
+	s.logger().Printf("%v: New session", s.id)
 	return s
 }
 
 // Mail is called on the MAIL SMTP command, it only stores the from address
 func (s *Session) Mail(from string, _ smtp.MailOptions) error {
-	log.Printf("%v: MAIL: %v", s.id, from)
+	s.logger().Printf("%v: MAIL: %v", s.id, from)
 	s.from = from
 	return nil
 }
@@ -48,7 +73,7 @@ func (s *Session) Mail(from string, _ smtp.MailOptions) error {
 // Rcpt is called on the RCPT SMTP command, it stores the to address. It may be
 // called multiple times in one session.
 func (s *Session) Rcpt(to string) error {
-	log.Printf("%v: RCPT: %v", s.id, to)
+	s.logger().Printf("%v: RCPT: %v", s.id, to)
 	s.to = append(s.to, to)
 	return nil
 }
@@ -56,81 +81,537 @@ func (s *Session) Rcpt(to string) error {
 // Data is called on the DATA SMTP command. It generally contains the "message"
 // but also any other informational headers such as the mailer client and
 // subject. This is seen as the "finished" command for each session, so it
-// triggers the HTTP post, though technically Reset and Logout wil be called
+// triggers delivery, though technically Reset and Logout wil be called
 // afterwards.
 func (s *Session) Data(r io.Reader) error {
 	b, err := io.ReadAll(r)
 	if err != nil {
-		log.Fatalf("%v: %v", s.id, err)
+		s.logger().Fatalf("%v: %v", s.id, err)
 	}
-	log.Printf("%v: DATA: [redacted (%d bytes)]", s.id, len(b))
+	s.logger().Printf("%v: DATA: [redacted (%d bytes)]", s.id, len(b))
 
-	// store the raw data and generate a mail.Message too
-	s.data = string(b)
-	s.message, err = mail.ReadMessage(strings.NewReader(s.data))
-	if err != nil {
+	if err := s.read(string(b)); err != nil {
 		// There is a world where reading the message fails, but we could still send
 		// raw data but not sure what the best user interface for that is. For now we
 		// just die.
-		log.Printf("%v: mail.ReadMessage failed (misbehaving sender?), refusing to post: %v", s.id, err)
+		s.logger().Printf("%v: mail.ReadMessage failed (misbehaving sender?), refusing to post: %v", s.id, err)
 		return err
 	}
-	b, _ = io.ReadAll(s.message.Body)
-	s.body = string(b)
 
-	// DATA dispatch POST request
-	endpoint := &dispatch.Endpoint{
-		URL:     s.config.URL,
-		Headers: s.config.Headers,
+	if stop, err := s.applyRules(); stop {
+		return err
 	}
 
-	templateData := s.TemplateData()
+	var fingerprint string
+	if s.config.Dedup.Enabled() && !s.redelivery {
+		fingerprint, err = s.fingerprint()
+		if err != nil {
+			s.logger().Printf("%v: Could not fingerprint message, not checking for duplicates: %v", s.id, err)
+		}
+	}
+	if fingerprint != "" {
+		if original, n, ok := reserve(fingerprint, s.id, s.config.Dedup.TTL); ok {
+			// the client has nothing to retry, so it's accepted
+			duplicatesSuppressed.Add(1)
+			s.logger().Printf("%v: Duplicate suppressed, duplicate_of=%v duplicates=%d", s.id, original, n)
+			return nil
+		}
+	}
 
-	status, err := dispatch.POST(endpoint, s.config.Template, templateData)
+	if err := s.accept(); err != nil {
+		if fingerprint != "" {
+			// the client's retry isn't a duplicate
+			release(fingerprint, s.id)
+		}
+		return err
+	}
+	return nil
+}
+
+// accept queues or delivers the message, an error means the client should be
+// told it wasn't accepted.
+func (s *Session) accept() error {
+	// routed before queueing, so the client hears about mail no route takes
+	targets := s.targets()
+	if len(targets) == 0 {
+		s.logger().Printf("%v: No route matched", s.id)
+		return errNoRoute
+	}
+	targets = s.pendingTargets(targets)
+	targets, err := s.checkSize(targets)
 	if err != nil {
-		log.Printf("%v: POST failed: %v", s.id, err)
+		return err
+	}
+
+	if s.config.Queue != nil && !s.redelivery {
+		if !s.config.Queue.Submit(s.spoolMessage()) {
+			s.logger().Printf("%v: Delivery queue full", s.id)
+			return errQueueFull
+		}
+		s.sent = true
+		s.logger().Printf("%v: Delivery queued", s.id)
+		return nil
+	}
+
+	// every endpoint is tried, a failure means the client retries them all
+	var firstErr error
+	for i, target := range targets {
+		var err error
+		if target.Batch == nil {
+			if err = s.deliver(target); err != nil {
+				s.failed = append(s.failed, target.Key())
+			}
+		} else if i == 0 || targets[i-1].Route != target.Route {
+			// a route's targets are together, its batch takes them all at once
+			route := routeTargets(targets[i:])
+			if err = s.batch(route); err != nil {
+				for _, target := range route {
+					s.failed = append(s.failed, target.Key())
+				}
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(s.deferred) == 0 {
+		return firstErr
+	}
+	if firstErr != nil {
+		// spooling would deliver them twice
+		s.logger().Printf("%v: Not spooling deferred deliveries, the client will retry them", s.id)
+		return firstErr
+	}
+	return s.spoolDeferred()
+}
+
+// pendingTargets returns the targets a redelivery still has to reach
+func (s *Session) pendingTargets(targets []config.Target) []config.Target {
+	if s.pending == nil {
+		return targets
+	}
+	var kept []config.Target
+	for _, target := range targets {
+		if slices.Contains(s.pending, target.Key()) {
+			kept = append(kept, target)
+		}
+	}
+	for _, key := range s.pending {
+		if !slices.ContainsFunc(kept, func(target config.Target) bool { return target.Key() == key }) {
+			s.logger().Printf("%v: Delivery to %q skipped, it is no longer a target", s.id, key)
+		}
+	}
+	return kept
+}
+
+// applyRules runs the config's rules over the message, setting its variables
+// and route. It returns true when a rule dropped or rejected the message, with
+// the error to give the client.
+func (s *Session) applyRules() (bool, error) {
+	vars, rule := s.config.ApplyRules(s.ruleMessage())
+	s.vars = vars
+	if rule == nil {
+		return false, nil
+	}
+	switch rule.Action {
+	case config.RuleRouteTo:
+		s.route = rule.Route
+		s.logger().Printf("%v: Routed to %q by rule %q", s.id, rule.Route.Name, rule.Name)
+		return false, nil
+	case config.RuleReject:
+		if s.redelivery {
+			// the client was already told it was accepted
+			s.logger().Printf("%v: Dropped by rule %q, which rejects mail", s.id, rule.Name)
+			return true, nil
+		}
+		s.logger().Printf("%v: Rejected by rule %q", s.id, rule.Name)
+		return true, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      rule.Message,
+		}
+	}
+	s.logger().Printf("%v: Dropped by rule %q", s.id, rule.Name)
+	return true, nil
+}
+
+func (s *Session) ruleMessage() *config.RuleMessage {
+	return &config.RuleMessage{
+		Sender:     s.from,
+		Recipients: s.to,
+		Header:     s.message.Header,
+		Body:       s.body,
+		Text:       s.text,
+		Size:       len(s.data),
+	}
+}
+
+// targets are where the message goes, its rules' route or the matching routes
+func (s *Session) targets() []config.Target {
+	if s.route != nil {
+		return s.route.Targets()
+	}
+	return s.config.Targets(s.from, s.to, s.message.Header.Get("Subject"))
+}
+
+// routeTargets returns the targets at the start of targets with the same
+// route as the first
+func routeTargets(targets []config.Target) []config.Target {
+	n := 1
+	for n < len(targets) && targets[n].Route == targets[0].Route {
+		n++
+	}
+	return targets[:n]
+}
+
+// read stores the raw data and generates a mail.Message too
+func (s *Session) read(data string) error {
+	s.data = data
+	message, err := mail.ReadMessage(strings.NewReader(s.data))
+	if err != nil {
+		return err
+	}
+	s.message = message
+	b, _ := io.ReadAll(s.message.Body)
+	s.body = string(b)
+	s.text, s.html = textParts(textproto.MIMEHeader(s.message.Header), s.body)
+	return nil
+}
+
+// deliver dispatches the message to one endpoint
+func (s *Session) deliver(target config.Target) error {
+	templateData := s.TemplateData()
+	s.limit(templateData, target)
+
+	status, resp, err := dispatch.DeliverContext(s.context(), target.Endpoint, target.Template, templateData)
+	if errors.Is(err, dispatch.ErrCircuitOpen) {
+		return s.circuitOpen(target, err)
+	} else if errors.Is(err, dispatch.ErrRateLimited) {
+		return s.overflow(target, err)
+	} else if errors.Is(err, dispatch.ErrUnavailable) {
+		// the client tries again later
+		s.logger().Printf("%v: Delivery%v failed: %v", s.id, s.describe(target), err)
+		err = errEndpointUnavailable
+	} else if err != nil {
+		s.logger().Printf("%v: Delivery%v failed: %v", s.id, s.describe(target), err)
 	} else {
 		s.sent = true
-		log.Printf("%v: POST returned status: %v", s.id, status)
+		s.logger().Printf("%v: Delivery%v returned status: %v", s.id, s.describe(target), status)
+	}
+	if resp != nil {
+		// later dispatches of this message can use the response, eg a thread ID
+		s.responses = append(s.responses, resp)
+		if !resp.OK() {
+			s.logger().Printf("%v: Endpoint response: %v", s.id, resp)
+		}
 	}
 
 	return err
 }
 
+// describe names the route and endpoint for logs when routes are configured
+func (s *Session) describe(target config.Target) string {
+	if len(s.config.Routes) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (route %q, endpoint %q)", target.Route, target.Endpoint.Name)
+}
+
+// overflow handles a message that could not be queued for delivery, according
+// to the configured rate limit overflow behaviour.
+func (s *Session) overflow(target config.Target, err error) error {
+	rateLimit := target.Endpoint.RateLimit
+	switch {
+	case s.redelivery:
+		// already spooled, leave it there for the next attempt
+		return err
+	case rateLimit.Overflow == "spool" && s.config.Spool != nil:
+		s.spoolLater(target, err)
+		return nil
+	case rateLimit.Overflow == "drop":
+		s.logger().Printf("%v: Delivery dropped: %v", s.id, err)
+		return nil
+	default:
+		s.logger().Printf("%v: Delivery deferred: %v", s.id, err)
+		return errRateLimited
+	}
+}
+
+// circuitOpen handles a message for an endpoint whose circuit breaker is open.
+// The target is left for the spool if there is one, otherwise the client is
+// asked to retry.
+func (s *Session) circuitOpen(target config.Target, err error) error {
+	if s.redelivery || s.config.Spool == nil {
+		// already spooled or queued, or nowhere to keep it
+		s.logger().Printf("%v: Delivery%v deferred: %v", s.id, s.describe(target), err)
+		return errEndpointUnavailable
+	}
+	s.spoolLater(target, err)
+	return nil
+}
+
+// spoolLater leaves the target for the spool to deliver to later
+func (s *Session) spoolLater(target config.Target, reason error) {
+	s.deferred = append(s.deferred, target.Key())
+	s.logger().Printf("%v: Delivery%v deferred to the spool: %v", s.id, s.describe(target), reason)
+}
+
+// spoolDeferred spools the message for the spool to deliver to the deferred
+// targets later, once every target was tried.
+func (s *Session) spoolDeferred() error {
+	msg := s.spoolMessage()
+	msg.Pending = s.deferred
+	if err := s.config.Spool.Write(msg); err != nil {
+		s.logger().Printf("%v: Spooling failed: %v", s.id, err)
+		return errEndpointUnavailable
+	}
+	s.logger().Printf("%v: Delivery spooled for %v", s.id, strings.Join(s.deferred, ", "))
+	return nil
+}
+
 var zeroSession = &Session{}
 
+// errEndpointUnavailable asks the client to retry later
+var errEndpointUnavailable = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+	Message:      "Endpoint unavailable, try again later",
+}
+
+// errNoRoute refuses mail that no route accepts
+var errNoRoute = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "No route for this message",
+}
+
+// errQueueFull asks the client to back off and retry later
+var errQueueFull = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Delivery queue full, try again later",
+}
+
+// errRateLimited asks the client to retry later
+var errRateLimited = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Too many messages, try again later",
+}
+
 // Reset is called on the RSET SMTP command, or after a successful DATA command
-// It will log whether the current session did or not make a post request.
+// It will log whether the current session did or not deliver its message.
 func (s *Session) Reset() {
 	if s.sent {
-		log.Printf("%v: Session reset after POST", s.id)
+		s.logger().Printf("%v: Session reset after delivery", s.id)
 	} else {
-		log.Printf("%v: Session reset without POST", s.id)
+		s.logger().Printf("%v: Session reset without delivery", s.id)
 	}
 	new := NewSession(s.config)
 	*s = *new
 }
 
 // Logout is called when a connection is terminated.
-// It will log whether the current session did or not make a post request.
+// It will log whether the current session did or not deliver its message.
 func (s *Session) Logout() error {
 	if s.sent {
-		log.Printf("%v: Session logout after POST", s.id)
+		s.logger().Printf("%v: Session logout after delivery", s.id)
 	} else {
-		log.Printf("%v: Session logout without POST", s.id)
+		s.logger().Printf("%v: Session logout without delivery", s.id)
 	}
 	s.ended = true
 	return nil
 }
 
+// TemplateData is what templates see of the message, after redaction
 func (s *Session) TemplateData() *dispatch.TemplateData {
-	return &dispatch.TemplateData{
+	data := &dispatch.TemplateData{
 		ID:         s.id,
 		Timestamp:  s.timestamp,
 		Sender:     s.from,
 		Recipients: s.to,
+		Recipient:  s.recipient(),
 		Data:       s.data,
 		Body:       s.body,
+		Text:       s.text,
+		HTML:       s.html,
 		Header:     s.message.Header,
+		Subject:    subject(s.message.Header),
+		Responses:  s.responses,
+		Vars:       s.vars,
+	}
+	s.redact(data)
+	return data
+}
+
+// context returns the session's context, or the background context
+func (s *Session) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+func (s *Session) logger() *log.Logger {
+	return s.config.Logger()
+}
+
+// UseConfig changes the configuration used for the session's next message
+func (s *Session) UseConfig(config *config.Config) {
+	s.config = config
+}
+
+// subject returns the message's Subject header, decoded if it is RFC 2047
+// encoded
+func subject(header mail.Header) string {
+	var decoder mime.WordDecoder
+	value := header.Get("Subject")
+	if decoded, err := decoder.DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// recipient returns the first RCPT address, which is usually the only one.
+func (s *Session) recipient() dispatch.Address {
+	if len(s.to) == 0 {
+		return dispatch.Address{}
+	}
+	return dispatch.NewAddress(s.to[0])
+}
+
+func (s *Session) spoolMessage() *spool.Message {
+	return &spool.Message{
+		ID:         s.id,
+		Timestamp:  s.timestamp,
+		Sender:     s.from,
+		Recipients: s.to,
+		Data:       s.data,
+	}
+}
+
+// Redeliver runs an already accepted (queued or spooled) message through a new
+// session, keeping its original ID and timestamp, to its pending targets. An
+// error means the message was not delivered to all of them, msg.Pending is
+// then the targets it still has to be.
+func Redeliver(config *config.Config, msg *spool.Message) error {
+	pending, err := redeliver(context.Background(), config, msg)
+	if err != nil {
+		msg.Pending = pending
+	}
+	return err
+}
+
+// redeliver returns the keys of the targets the message still has to be
+// delivered to when it fails.
+func redeliver(ctx context.Context, config *config.Config, msg *spool.Message) ([]string, error) {
+	s := &Session{
+		id:         msg.ID,
+		config:     config,
+		timestamp:  msg.Timestamp,
+		from:       msg.Sender,
+		to:         msg.Recipients,
+		redelivery: true,
+		pending:    msg.Pending,
+		ctx:        ctx,
+	}
+	s.logger().Printf("%v: Delivering accepted message", s.id)
+	err := s.Data(strings.NewReader(msg.Data))
+	if err != nil && len(s.failed) > 0 {
+		return s.failed, err
+	}
+	return msg.Pending, err
+}
+
+// DeliverQueued delivers a message taken from the queue. The client has
+// already been told it was accepted, so failures, including deliveries
+// cancelled by ctx, are spooled if possible for the targets that weren't
+// delivered to.
+func DeliverQueued(ctx context.Context, config *config.Config, msg *spool.Message) {
+	pending, err := redeliver(ctx, config, msg)
+	if err == nil {
+		return
+	}
+	Persist(config, msg, pending, "Queued delivery failed")
+}
+
+// Persist spools an accepted message that was not delivered to pending, the
+// keys of the targets it still has to reach or nil for all of them. It is
+// logged as lost if there is no spool.
+func Persist(config *config.Config, msg *spool.Message, pending []string, reason string) {
+	if config.Spool == nil {
+		config.Logger().Printf("%v: %v, message lost", msg.ID, reason)
+		return
+	}
+	spooled := *msg
+	spooled.Pending = pending
+	if err := config.Spool.Write(&spooled); err != nil {
+		config.Logger().Printf("%v: Spooling failed, message lost: %v", msg.ID, err)
+		return
+	}
+	config.Logger().Printf("%v: %v, spooled", msg.ID, reason)
+}
+
+// Preview is what a message renders to for one target
+type Preview struct {
+	Target    config.Target
+	Rendering *dispatch.Rendering
+	Err       error
+}
+
+// Render parses and routes a message as delivery would, and renders it for
+// every target without delivering it. Errors rendering a target are in its
+// Preview, an error is only returned when a rule drops or rejects the message,
+// it can't be routed or it is too big for every route.
+func Render(cfg *config.Config, msg *spool.Message) ([]Preview, error) {
+	s := &Session{
+		id:        msg.ID,
+		config:    cfg,
+		timestamp: msg.Timestamp,
+		from:      msg.Sender,
+		to:        msg.Recipients,
+	}
+	if err := s.read(msg.Data); err != nil {
+		return nil, fmt.Errorf("Could not parse message: %v", err)
+	}
+	vars, rule := cfg.ApplyRules(s.ruleMessage())
+	s.vars = vars
+	if rule != nil {
+		switch rule.Action {
+		case config.RuleDrop:
+			return nil, fmt.Errorf("Dropped by rule %q", rule.Name)
+		case config.RuleReject:
+			return nil, fmt.Errorf("Rejected by rule %q: %v", rule.Name, rule.Message)
+		case config.RuleRouteTo:
+			s.route = rule.Route
+		}
+	}
+	targets := s.targets()
+	if len(targets) == 0 {
+		return nil, errNoRoute
+	}
+	var previews []Preview
+	tooBig := 0
+	for _, target := range targets {
+		if target.Limits.Rejects(len(s.data)) {
+			tooBig++
+			err := fmt.Errorf("Too big for route %q, %d bytes is over %d", target.Route, len(s.data), target.Limits.RejectAbove)
+			previews = append(previews, Preview{Target: target, Err: err})
+			continue
+		}
+		data, tmpl := s.TemplateData(), target.Template
+		s.limit(data, target)
+		if target.Batch != nil {
+			// as a batch of one
+			message := *data
+			data.Messages = []*dispatch.TemplateData{&message}
+			tmpl = target.Batch.Template
+		}
+		rendering, err := dispatch.Render(target.Endpoint, tmpl, data)
+		previews = append(previews, Preview{Target: target, Rendering: rendering, Err: err})
+	}
+	if tooBig == len(targets) {
+		return nil, fmt.Errorf("Too big for every route, %d bytes", len(s.data))
 	}
+	return previews, nil
 }
@@ -1,14 +1,20 @@
 package session
 
 import (
+	"context"
 	"github.com/emersion/go-smtp"
 	"github.com/rktjmp/smtp-pigeon/internal/config"
+	"github.com/rktjmp/smtp-pigeon/internal/queue"
+	"github.com/rktjmp/smtp-pigeon/internal/spool"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/mail"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -130,3 +136,369 @@ func TestTemplateData(t *testing.T) {
 	assert.Equal(td.Body, "my-message")
 	assert.IsType(td.Header, mail.Header{})
 }
+
+func TestDataTempfailsWhenCircuitOpen(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	cfg, _ := config.NewConfig(server.URL, []string{}, "{{.ID}}", false)
+	cfg.Breaker = &config.BreakerOptions{Threshold: 1, OpenFor: time.Minute}
+	data := "Subject: hi\n\nbody"
+
+	session := NewSession(cfg)
+	session.Rcpt("a@host")
+	assert.NotNil(session.Data(strings.NewReader(data)))
+
+	session.Reset()
+	session.Rcpt("a@host")
+	err := session.Data(strings.NewReader(data))
+	smtpErr, ok := err.(*smtp.SMTPError)
+	assert.True(ok)
+	assert.Equal(451, smtpErr.Code)
+	assert.Equal(smtp.EnhancedCode{4, 4, 1}, smtpErr.EnhancedCode)
+}
+
+func TestDataTempfailsWhenEndpointUnavailable(t *testing.T) {
+	assert := assert.New(t)
+
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	cfg, _ := config.NewConfig(server.URL, []string{}, "{{.ID}}", false)
+	deliver := func() error {
+		session := NewSession(cfg)
+		session.Rcpt("a@host")
+		return session.Data(strings.NewReader("Subject: hi\n\nbody"))
+	}
+	for _, status = range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		err := deliver()
+		smtpErr, ok := err.(*smtp.SMTPError)
+		if assert.True(ok, "%d is retried", status) {
+			assert.Equal(451, smtpErr.Code)
+		}
+	}
+
+	// retrying wouldn't help a rejected payload
+	status = http.StatusBadRequest
+	assert.Nil(deliver())
+}
+
+func TestDataSpoolsWhenCircuitOpen(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	sp, _ := spool.NewSpool(t.TempDir())
+	cfg, _ := config.NewConfig(server.URL, []string{}, "{{.ID}}", false)
+	cfg.Breaker = &config.BreakerOptions{Threshold: 1, OpenFor: time.Minute}
+	cfg.Spool = sp
+	data := "Subject: hi\n\nbody"
+
+	session := NewSession(cfg)
+	session.Rcpt("a@host")
+	assert.NotNil(session.Data(strings.NewReader(data)))
+
+	// the endpoint isn't tried, the message waits in the spool
+	session.Reset()
+	session.Rcpt("a@host")
+	assert.Nil(session.Data(strings.NewReader(data)))
+	messages, _ := sp.Messages()
+	assert.Equal(1, len(messages))
+
+	// spooled messages stay there while the circuit is open
+	assert.NotNil(Redeliver(cfg, messages[0]))
+}
+
+// twoEndpointConfig routes every message to endpoints a and b, b fails until
+// failing is cleared. hits counts deliveries by endpoint.
+func twoEndpointConfig(t *testing.T) (*config.Config, map[string]int, *atomic.Bool) {
+	var mu sync.Mutex
+	hits := map[string]int{}
+	failing := &atomic.Bool{}
+	failing.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/b" && failing.Load() {
+			panic(http.ErrAbortHandler)
+		}
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	cfg, _ := config.NewConfig(server.URL, []string{}, "{{.ID}}", false)
+	a, _ := config.NewEndpoint("a", server.URL+"/a", nil, "{{.ID}}", nil)
+	b, _ := config.NewEndpoint("b", server.URL+"/b", nil, "{{.ID}}", nil)
+	cfg.Routes = []*config.Route{{Name: "all", Endpoints: []*config.Endpoint{a, b}}}
+	return cfg, hits, failing
+}
+
+func TestDataSpoolsOnlyDeferredTargets(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, hits, failing := twoEndpointConfig(t)
+	cfg.Routes[0].Endpoints[1].Breaker = &config.BreakerOptions{Threshold: 1, OpenFor: 50 * time.Millisecond}
+	sp, _ := spool.NewSpool(t.TempDir())
+	cfg.Spool = sp
+
+	// b fails and its circuit opens
+	session := NewSession(cfg)
+	session.Rcpt("a@host")
+	assert.NotNil(session.Data(strings.NewReader("Subject: hi\n\nbody")))
+
+	// a gets the next message, it waits in the spool for b alone
+	session.Reset()
+	session.Rcpt("a@host")
+	assert.Nil(session.Data(strings.NewReader("Subject: hi\n\nbody")))
+	assert.Equal(2, hits["/a"])
+	messages, _ := sp.Messages()
+	if !assert.Equal(1, len(messages)) {
+		return
+	}
+	assert.Equal([]string{"all/b"}, messages[0].Pending)
+
+	// replays while b is down don't deliver to a again
+	sp.Replay(func(msg *spool.Message) error { return Redeliver(cfg, msg) })
+	failing.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	remaining, err := sp.Replay(func(msg *spool.Message) error { return Redeliver(cfg, msg) })
+	assert.Nil(err)
+	assert.Equal(0, remaining)
+	assert.Equal(2, hits["/a"])
+	assert.Equal(1, hits["/b"])
+}
+
+func rateLimitedConfig(t *testing.T, overflow string) (*config.Config, *spool.Spool) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(server.Close)
+
+	sp, _ := spool.NewSpool(t.TempDir())
+	cfg, _ := config.NewConfig(server.URL, []string{}, "{{.ID}}", false)
+	// one delivery, then nothing for a long time and no queue
+	cfg.RateLimit = &config.RateLimitOptions{PerSecond: 0.001, Burst: 1, MaxQueue: 0, Overflow: overflow}
+	cfg.Spool = sp
+	return cfg, sp
+}
+
+func deliverTwice(cfg *config.Config) error {
+	session := NewSession(cfg)
+	session.Rcpt("a@host")
+	session.Data(strings.NewReader("Subject: hi\n\nbody"))
+	session.Reset()
+	session.Rcpt("a@host")
+	return session.Data(strings.NewReader("Subject: hi\n\nbody"))
+}
+
+func TestDataRateLimitOverflow(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, _ := rateLimitedConfig(t, "tempfail")
+	err := deliverTwice(cfg)
+	smtpErr, ok := err.(*smtp.SMTPError)
+	assert.True(ok)
+	assert.Equal(451, smtpErr.Code)
+
+	cfg, sp := rateLimitedConfig(t, "drop")
+	assert.Nil(deliverTwice(cfg))
+	messages, _ := sp.Messages()
+	assert.Equal(0, len(messages))
+
+	cfg, sp = rateLimitedConfig(t, "spool")
+	assert.Nil(deliverTwice(cfg))
+	messages, _ = sp.Messages()
+	assert.Equal(1, len(messages))
+	assert.Equal([]string{"a@host"}, messages[0].Recipients)
+	assert.Equal("Subject: hi\n\nbody", messages[0].Data)
+
+	// still limited, so redelivery fails and the message stays spooled
+	assert.NotNil(Redeliver(cfg, messages[0]))
+}
+
+func TestDataRateLimitSpoolsOnlyOverflowingTarget(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, hits, failing := twoEndpointConfig(t)
+	failing.Store(false)
+	cfg.Routes[0].Endpoints[1].RateLimit = &config.RateLimitOptions{PerSecond: 0.001, Burst: 1, MaxQueue: 0, Overflow: "spool"}
+	sp, _ := spool.NewSpool(t.TempDir())
+	cfg.Spool = sp
+
+	assert.Nil(deliverTwice(cfg))
+	assert.Equal(2, hits["/a"])
+	assert.Equal(1, hits["/b"])
+	messages, _ := sp.Messages()
+	if !assert.Equal(1, len(messages)) {
+		return
+	}
+	assert.Equal([]string{"all/b"}, messages[0].Pending)
+
+	// b is still limited, a doesn't get the message again
+	remaining, _ := sp.Replay(func(msg *spool.Message) error { return Redeliver(cfg, msg) })
+	assert.Equal(1, remaining)
+	assert.Equal(2, hits["/a"])
+}
+
+func TestRedeliver(t *testing.T) {
+	assert := assert.New(t)
+
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer server.Close()
+
+	cfg, _ := config.NewConfig(server.URL, []string{}, "{{.ID}} {{.Sender}} {{.Body}}", false)
+	err := Redeliver(cfg, &spool.Message{
+		ID:         "spooled-id",
+		Timestamp:  time.Now(),
+		Sender:     "me@host",
+		Recipients: []string{"you@host"},
+		Data:       "Subject: hi\n\nbody",
+	})
+	assert.Nil(err)
+	assert.Equal("spooled-id me@host body", body)
+}
+
+func TestDataAsync(t *testing.T) {
+	assert := assert.New(t)
+
+	delivered := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		delivered <- string(b)
+	}))
+	defer server.Close()
+
+	cfg, _ := config.NewConfig(server.URL, []string{}, "{{.ID}}", false)
+	cfg.Queue = queue.NewQueue(1, 1, func(ctx context.Context, msg *spool.Message) {
+		DeliverQueued(ctx, cfg, msg)
+	})
+
+	session := NewSession(cfg)
+	session.Rcpt("a@host")
+	id := session.id
+	assert.Nil(session.Data(strings.NewReader("Subject: hi\n\nbody")))
+	assert.Equal(id, <-delivered)
+}
+
+func TestDataAsyncQueueFull(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, _ := config.NewConfig("http://localhost", []string{}, "{{.ID}}", false)
+	// no workers, so nothing leaves the queue
+	cfg.Queue = queue.NewQueue(0, 1, func(ctx context.Context, msg *spool.Message) {})
+
+	session := NewSession(cfg)
+	session.Rcpt("a@host")
+	assert.Nil(session.Data(strings.NewReader("Subject: hi\n\nbody")))
+	session.Reset()
+	session.Rcpt("a@host")
+	err := session.Data(strings.NewReader("Subject: hi\n\nbody"))
+	smtpErr, ok := err.(*smtp.SMTPError)
+	assert.True(ok)
+	assert.Equal(421, smtpErr.Code)
+}
+
+func TestDeliverQueuedSpoolsFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	sp, _ := spool.NewSpool(t.TempDir())
+	cfg, _ := config.NewConfig(server.URL, []string{}, "{{.ID}}", false)
+	cfg.Spool = sp
+
+	DeliverQueued(context.Background(), cfg, &spool.Message{ID: "queued-id", Timestamp: time.Now(), Data: "Subject: hi\n\nbody"})
+	messages, _ := sp.Messages()
+	assert.Equal(1, len(messages))
+	assert.Equal("queued-id", messages[0].ID)
+}
+
+func TestDeliverQueuedSpoolsFailedTargets(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, hits, failing := twoEndpointConfig(t)
+	sp, _ := spool.NewSpool(t.TempDir())
+	cfg.Spool = sp
+
+	DeliverQueued(context.Background(), cfg, &spool.Message{ID: "queued-id", Timestamp: time.Now(), Recipients: []string{"a@host"}, Data: "Subject: hi\n\nbody"})
+	messages, _ := sp.Messages()
+	if !assert.Equal(1, len(messages)) {
+		return
+	}
+	assert.Equal([]string{"all/b"}, messages[0].Pending)
+
+	failing.Store(false)
+	assert.Nil(Redeliver(cfg, messages[0]))
+	assert.Equal(1, hits["/a"])
+	assert.Equal(1, hits["/b"])
+}
+
+func TestDataRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		paths = append(paths, r.URL.Path+" "+string(b))
+	}))
+	defer server.Close()
+
+	cfg, _ := config.NewConfig(server.URL, []string{}, "{{.ID}}", false)
+	alerts, _ := config.NewEndpoint("alerts", server.URL+"/alerts", nil, "alert {{.Recipient.Local}}", nil)
+	cfg.Routes = []*config.Route{
+		{Name: "alerts", Recipient: regexp.MustCompile("^alerts@"), Endpoints: []*config.Endpoint{alerts}},
+	}
+
+	session := NewSession(cfg)
+	session.Rcpt("alerts@host")
+	assert.Nil(session.Data(strings.NewReader("Subject: hi\n\nbody")))
+	assert.Equal([]string{"/alerts alert alerts"}, paths)
+
+	// no route, no delivery
+	session = NewSession(cfg)
+	session.Rcpt("someone@host")
+	err := session.Data(strings.NewReader("Subject: hi\n\nbody"))
+	smtpErr, ok := err.(*smtp.SMTPError)
+	assert.True(ok)
+	assert.Equal(550, smtpErr.Code)
+	assert.Equal(1, len(paths))
+}
+
+func TestRender(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, _ := config.NewConfig("http://localhost", []string{}, "{{.ID}}", false)
+	alerts, _ := config.NewEndpoint("alerts", "http://alerts/{{.Recipient.Local}}", nil, "{{.Body}}", nil)
+	broken, _ := config.NewEndpoint("broken", "http://broken", nil, "{{(index .Responses 0).Status}}", nil)
+	cfg.Routes = []*config.Route{
+		{Name: "alerts", Recipient: regexp.MustCompile("^alerts@"), Endpoints: []*config.Endpoint{alerts, broken}},
+	}
+	msg := &spool.Message{ID: "id", Recipients: []string{"alerts@host"}, Data: "Subject: hi\n\nbody"}
+
+	previews, err := Render(cfg, msg)
+	assert.Nil(err)
+	if assert.Equal(2, len(previews)) {
+		assert.Equal("alerts", previews[0].Target.Route)
+		assert.Equal("http://alerts/alerts", previews[0].Rendering.URL)
+		assert.Equal("body", string(previews[0].Rendering.Body))
+		assert.Nil(previews[1].Rendering)
+		assert.NotNil(previews[1].Err)
+	}
+
+	msg.Recipients = []string{"someone@host"}
+	_, err = Render(cfg, msg)
+	assert.Equal(errNoRoute, err)
+}
@@ -0,0 +1,142 @@
+package spool
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Message is everything needed to deliver a message again
+type Message struct {
+	ID         string
+	Timestamp  time.Time
+	Sender     string
+	Recipients []string
+	Data       string
+	// Pending are the keys of the targets the message still has to be
+	// delivered to, nil for all of them
+	Pending []string `json:",omitempty"`
+}
+
+// Spool stores messages that could not be delivered yet as JSON files in a
+// directory, one per message, named by message ID.
+type Spool struct {
+	dir string
+}
+
+// NewSpool creates a spool in dir, creating the directory if needed
+func NewSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Could not create spool directory: %v", err)
+	}
+	return &Spool{dir: dir}, nil
+}
+
+// Write stores the message, replacing any spooled message with the same ID.
+func (s *Spool) Write(msg *Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	// write then rename so a crash never leaves a partial message behind
+	tmp, err := os.CreateTemp(s.dir, ".spooling-*")
+	if err != nil {
+		return fmt.Errorf("Could not spool message: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Could not spool message: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Could not spool message: %v", err)
+	}
+	return os.Rename(tmp.Name(), s.path(msg.ID))
+}
+
+// Messages returns every spooled message, oldest first.
+func (s *Spool) Messages() ([]*Message, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var messages []*Message
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var msg Message
+		if err := json.Unmarshal(b, &msg); err != nil {
+			log.Printf("Skipping unreadable spool file %v: %v", path, err)
+			continue
+		}
+		messages = append(messages, &msg)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Timestamp.Before(messages[j].Timestamp)
+	})
+	return messages, nil
+}
+
+// Remove deletes a spooled message
+func (s *Spool) Remove(id string) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Replay calls deliver for each spooled message, oldest first, removing those
+// delivered without error. deliver may change a message's Pending targets
+// when it fails, the spooled message is updated to match. It returns how many
+// messages remain.
+func (s *Spool) Replay(deliver func(*Message) error) (int, error) {
+	messages, err := s.Messages()
+	if err != nil {
+		return 0, err
+	}
+	remaining := 0
+	for _, msg := range messages {
+		pending := slices.Clone(msg.Pending)
+		if err := deliver(msg); err != nil {
+			remaining++
+			if !slices.Equal(pending, msg.Pending) {
+				if err := s.Write(msg); err != nil {
+					return 0, err
+				}
+			}
+			continue
+		}
+		if err := s.Remove(msg.ID); err != nil {
+			return 0, err
+		}
+	}
+	return remaining, nil
+}
+
+// Sub returns a spool in a subdirectory, whose messages s doesn't see
+func (s *Spool) Sub(name string) (*Spool, error) {
+	return NewSpool(filepath.Join(s.dir, fileName(name)))
+}
+
+func (s *Spool) path(id string) string {
+	// IDs are generated UUIDs, but never let one escape the directory
+	return filepath.Join(s.dir, fileName(id)+".json")
+}
+
+// fileName makes name safe to use as a single path element
+func fileName(name string) string {
+	name = strings.NewReplacer("/", "_", string(filepath.Separator), "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "_" + name
+	}
+	return name
+}
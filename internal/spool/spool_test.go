@@ -0,0 +1,94 @@
+package spool
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteAndMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	sp, err := NewSpool(filepath.Join(t.TempDir(), "spool"))
+	assert.Nil(err)
+
+	now := time.Now()
+	assert.Nil(sp.Write(&Message{ID: "second", Timestamp: now, Data: "b"}))
+	assert.Nil(sp.Write(&Message{ID: "first", Timestamp: now.Add(-time.Minute), Sender: "me@host", Recipients: []string{"you@host"}, Data: "a"}))
+
+	messages, err := sp.Messages()
+	assert.Nil(err)
+	assert.Equal(2, len(messages))
+	assert.Equal("first", messages[0].ID, "oldest first")
+	assert.Equal("me@host", messages[0].Sender)
+	assert.Equal([]string{"you@host"}, messages[0].Recipients)
+	assert.Equal("second", messages[1].ID)
+}
+
+func TestReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	sp, err := NewSpool(t.TempDir())
+	assert.Nil(err)
+	sp.Write(&Message{ID: "ok", Timestamp: time.Now()})
+	sp.Write(&Message{ID: "fails", Timestamp: time.Now()})
+	sp.Write(&Message{ID: "partly", Timestamp: time.Now(), Pending: []string{"a", "b"}})
+
+	remaining, err := sp.Replay(func(msg *Message) error {
+		switch msg.ID {
+		case "fails":
+			return fmt.Errorf("still down")
+		case "partly":
+			msg.Pending = []string{"b"}
+			return fmt.Errorf("b still down")
+		}
+		return nil
+	})
+	assert.Nil(err)
+	assert.Equal(2, remaining)
+
+	messages, _ := sp.Messages()
+	if assert.Equal(2, len(messages)) {
+		for _, msg := range messages {
+			if msg.ID == "partly" {
+				assert.Equal([]string{"b"}, msg.Pending, "only the undelivered targets are left")
+			} else {
+				assert.Equal("fails", msg.ID)
+				assert.Nil(msg.Pending)
+			}
+		}
+	}
+}
+
+func TestPathStaysInSpool(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	sp, _ := NewSpool(dir)
+	assert.Nil(sp.Write(&Message{ID: "../escape"}))
+	_, err := os.Stat(filepath.Join(dir, ".._escape.json"))
+	assert.Nil(err)
+}
+
+func TestSub(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	sp, _ := NewSpool(dir)
+	sub, err := sp.Sub("../batch/alerts")
+	assert.Nil(err)
+	assert.Nil(sub.Write(&Message{ID: "batched", Timestamp: time.Now()}))
+	assert.FileExists(filepath.Join(dir, ".._batch_alerts", "batched.json"))
+
+	// the parent doesn't see the subdirectory's messages
+	messages, err := sp.Messages()
+	assert.Nil(err)
+	assert.Empty(messages)
+
+	dot, _ := sp.Sub("..")
+	assert.Nil(dot.Write(&Message{ID: "x"}))
+	assert.FileExists(filepath.Join(dir, "_..", "x.json"))
+}